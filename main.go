@@ -18,7 +18,10 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -28,8 +31,13 @@ import (
 )
 
 const programUsage = `os-watcher - watch OpenShift v3 API for changes
-This program takes no arguments. Instead, it accepts several environment
-variables.
+Usage: os-explode
+       os-explode explode <namespace>/<name>[:<tag>|@<digest>]
+       os-explode import <archive.tar> [--ref <namespace>/<name>:<tag>]
+       os-explode retention --dry-run
+
+Without arguments, this program watches for images to explode until it is
+stopped. It is configured through several environment variables.
 
 API CONFIG:
 Set KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT to the hostname
@@ -38,9 +46,15 @@ to read a token from /var/run/secrets/kubernetes.io/serviceaccount, but
 this behavior may be overridden by the KUBERNETES_SERVICE_TOKEN
 environment variable.
 
-Optionally set OS_WATCH_NAMESPACE to a particular project to restrict the
-watch scope to that project. This will be necessary if you don't have
-permission to watch ImageStreams or list images at the cluster scope.
+Optionally set OS_WATCH_NAMESPACE to a comma-separated list of projects
+(globs allowed, e.g. "team-*,shared") to restrict the watch scope to those
+projects, and OS_WATCH_NAMESPACE_EXCLUDE to a list of projects to leave out
+(e.g. "openshift,openshift-*"). If you don't have permission to watch
+ImageStreams at the cluster scope, one watch runs per project instead: the
+projects named without globs, and the projects you can see which match the
+globs. Watches are started and stopped as you gain or lose access to the
+projects you can see, and Images are read through the ImageStreams, so no
+cluster-scoped access is needed.
 
 Optionally set OS_WATCH_INSECURE to "true" to indicate that the REST
 client should not perform certificate validation.
@@ -48,8 +62,129 @@ client should not perform certificate validation.
 BLOB SOURCE:
 Optionally set OS_IMAGE_BLOB_SOURCE to a URL. If the URL has the file://
 scheme, it will be treated as a local registry storage. If the URL has the
-https:// scheme, it will be treated as a remote docker registry. If unset,
-this value will default to "file:///registry/"
+https:// scheme, it will be treated as a remote docker registry, and blobs
+are streamed from it using the API token. If unset, this value will default
+to "file:///registry/"
+
+EXPLODE CONFIG:
+Optionally set OS_EXPLODE_LAYER_CONCURRENCY to the number of layers of a
+single image which may be decompressed and committed at once. Layers are
+still checked out in order. If unset, this value will default to 4.
+
+Layers are streamed from the blob source, decompressed and piped into
+OSTree's tar import without being unpacked or written out; the few files
+carrying xattrs are laid over the import with their xattrs. As imports are
+serialized, so is decompression. Optionally set OS_EXPLODE_LAYER_SPOOL to
+"true" to decompress layers onto the explode volume as tar files first,
+which lets them decompress in parallel, at the cost of room for a full
+uncompressed copy of each layer in flight.
+Optionally set OS_EXPLODE_UNPACK_FALLBACK to "true" to unpack layers which
+OSTree fails to import onto the explode volume as a last resort.
+
+Optionally set OS_EXPLODE_HISTORY_DEPTH to the number of images per tag to
+keep exploded, the newest included. Each of them is exposed as
+images/<namespace>/<name>/<tag>/history/<generation>, with a .1, .2...
+suffix for images sharing a generation. If unset, this value will default
+to 1, which keeps no history.
+
+FILTERING:
+Optionally set OS_EXPLODE_LABEL_SELECTOR to a label selector (e.g.
+"explode=true") to watch only the ImageStreams it matches.
+
+An ImageStream is exploded unless annotated with
+exploder.openshift.io/enabled=false. Optionally set OS_EXPLODE_OPT_IN to
+"true" to explode only streams annotated with
+exploder.openshift.io/enabled=true. Annotate a stream with
+exploder.openshift.io/tags set to a comma-separated list of globs (e.g.
+"latest,v1.*") to explode only the matching tags. Both annotations may be
+set on a Project to set the default for the streams within it.
+
+SELINUX:
+Optionally set OS_EXPLODE_SELINUX_CONTEXT to an SELinux context with which
+every exploded rootfs will be labeled (e.g.
+"system_u:object_r:container_file_t"). If the context has no level, each
+image gets its own MCS category pair derived from its digest. Labeled
+rootfs trees are full copies of their images rather than hardlinks into the
+OSTree repo, so they take up the uncompressed size of each image.
+
+PODS:
+Optionally set OS_EXPLODE_WATCH to "pods" to explode the images Pods run
+(as resolved in their container statuses) instead of every ImageStream tag,
+or to "imagestreams,pods" for both. If unset, this value will default to
+"imagestreams". Set OS_EXPLODE_NODE_NAME to only watch the Pods of one node,
+e.g. when running as a DaemonSet. Images of the integrated registry are read
+from the blob source; set OS_EXPLODE_POD_REGISTRY_SOURCE to a registry URL
+(e.g. a pull-through cache) to read images of other registries from. It is
+never sent the token; set OS_EXPLODE_POD_REGISTRY_AUTH to
+"<username>:<password>" if it needs credentials.
+
+REGISTRY NOTIFICATIONS:
+Optionally set OS_EXPLODE_NOTIFY_LISTEN to an address (e.g. ":8080") to
+listen for docker registry notifications instead of watching OpenShift.
+Point the registry's notifications.endpoints at http://<address>/notifications;
+pushed images are exploded and deleted ones removed, without any use of the
+Kubernetes API. Image manifests are read from the blob source. Set
+OS_EXPLODE_NOTIFY_TOKEN to the token notifications must carry in an
+"Authorization: Bearer <token>" header; to accept notifications without
+one, set OS_EXPLODE_NOTIFY_INSECURE to "true" instead. Notifications naming
+an invalid repository, tag or digest are rejected.
+
+DOCKER:
+Optionally set OS_EXPLODE_DOCKER_ENDPOINT to the endpoint of a local Docker
+daemon (e.g. "unix:///var/run/docker.sock") to explode its images as they
+are pulled, tagged, built, imported or loaded, instead of watching
+OpenShift. Images are exported from the daemon and exploded under their
+image ID.
+
+HIGH AVAILABILITY:
+Optionally set OS_EXPLODE_LEADER_ELECT to "true" to run several replicas
+against the same explode volume. Replicas elect a leader through an
+annotation on a ConfigMap, and only the leader watches and explodes images;
+standby replicas take over within seconds of the leader going away. Set
+OS_EXPLODE_LEADER_LOCK to the ConfigMap to use ([<namespace>/]<name>). If
+unset, this value will default to "os-explode" in the pod's namespace.
+
+GARBAGE COLLECTION:
+Deleting images only removes their checkouts. Optionally set
+OS_EXPLODE_GC_INTERVAL to a duration (e.g. "24h") to periodically delete
+the OSTree refs of images and layer prefixes which are no longer exploded,
+and prune the objects nothing reaches anymore; the bytes reclaimed are
+logged. Refs written within OS_EXPLODE_GC_KEEP_YOUNGER_THAN are kept, so
+recently dropped layers can still be reused. If unset, this value will
+default to "1h". Explodes wait while the repo is pruned. Requires the
+ostree command.
+
+RETENTION:
+Optionally set OS_EXPLODE_RETAIN_DIGESTS to the number of distinct digests
+to keep exploded per tag, the current one included; older history entries
+are removed, and so are the digests nothing refers to anymore. As only
+history entries are trimmed, it requires OS_EXPLODE_HISTORY_DEPTH to be
+greater than 1. Set
+OS_EXPLODE_RETAIN_TAGS to a comma-separated list of tags (globs allowed,
+e.g. "release-*") whose digests are kept forever. A Project may override
+both through its exploder.openshift.io/retain-digests and
+exploder.openshift.io/retain-tags annotations. Optionally set
+OS_EXPLODE_RETAIN_UNREFERENCED to a duration (e.g. "720h") after which
+digests no tag or Pod has used are removed. Retention is applied before
+each garbage collection. "os-explode retention --dry-run" prints, as JSON,
+what would be removed and why, without removing anything: the locks which
+keep retention off digests being exploded only live in the exploder's own
+process, so retention is only ever applied by it.
+
+ONE-SHOT:
+"os-explode explode <namespace>/<name>:<tag>" explodes a single image and
+updates its ref, then exits, e.g. for debugging or in CI pipelines. A tag
+(latest if omitted) is resolved through its ImageStreamTag, or, if
+KUBERNETES_SERVICE_HOST is unset, through the manifest the blob source
+holds for it. With "@<digest>" instead of a tag, only the digest is
+exploded. A JSON summary is printed on stdout, and the exit status is
+non-zero if the explode failed. Leader election is not taken part in.
+
+"os-explode import <archive.tar> --ref <namespace>/<name>:<tag>" explodes
+the image of a "docker save" archive or an OCI archive (which may be
+compressed), e.g. a vendor delivery, in the same way, and points the ref at
+it. Without --ref, only digest/ is written. The archive must hold a single
+image.
 
 STORAGE CONFIG:
 Set OSTREE_REPO_PATH to the location of the OSTree repo (e.g. /var/explode).
@@ -62,15 +197,95 @@ func init() {
 	log.SetLevel(log.InfoLevel)
 }
 
+// Parse the arguments of the import command: an archive, and optionally
+// the ref to point at its image
+func parseImportArgs(args []string) (archive, ref string, ok bool) {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--ref" && i+1 < len(args):
+			i++
+			ref = args[i]
+		case strings.HasPrefix(arg, "--ref="):
+			ref = strings.TrimPrefix(arg, "--ref=")
+		case strings.HasPrefix(arg, "-") || archive != "":
+			return "", "", false
+		default:
+			archive = arg
+		}
+	}
+	return archive, ref, archive != ""
+}
+
+// Print the summary of a one-shot explode on stdout, and exit with its
+// status
+func exitWithSummary(summary *watchclient.ExplodeSummary) {
+	json.NewEncoder(os.Stdout).Encode(summary)
+	if summary.Error != "" {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func main() {
+	var command, archive, ref string
+	ok := true
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "":
+	case "explode":
+		ok = len(os.Args) == 3
+	case "import":
+		archive, ref, ok = parseImportArgs(os.Args[2:])
+	case "retention":
+		// Digest locks are in-memory, so only the exploder's own process
+		// may remove anything
+		ok = len(os.Args) == 3 && os.Args[2] == "--dry-run"
+	default:
+		ok = false
+	}
+	if !ok {
+		fmt.Fprint(os.Stderr, programUsage)
+		os.Exit(2)
+	}
+
 	client, err := watchclient.NewWatchClient()
 	if err != nil {
 		log.WithField("err", err).Fatal("Could not create watch client.")
 	}
 
-	if err := client.OSTreeConfig.InitRepo(); err != nil {
-		client.Logger.Fatal(err)
+	if command != "" {
+		if err := client.OSTreeConfig.InitRepo(); err != nil {
+			client.Logger.Fatal(err)
+		}
+		switch command {
+		case "explode":
+			exitWithSummary(client.ExplodeOnce(os.Args[2]))
+		case "retention":
+			json.NewEncoder(os.Stdout).Encode(client.ApplyRetention(true))
+			os.Exit(0)
+		}
+		exitWithSummary(client.ImportArchive(archive, ref))
 	}
 
-	client.WatchImageStreams()
+	// Standby replicas don't touch the explode volume
+	client.RunAsLeader(func() {
+		if err := client.OSTreeConfig.InitRepo(); err != nil {
+			client.Logger.Fatal(err)
+		}
+		client.IndexRefs()
+		if client.GCInterval > 0 {
+			go client.RunGC()
+		}
+
+		switch {
+		case client.NotifyListen != "":
+			client.ServeNotifications()
+		case client.DockerClient != nil:
+			client.WatchDocker()
+		default:
+			client.Watch()
+		}
+	})
 }
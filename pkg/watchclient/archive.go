@@ -0,0 +1,294 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	dtar "github.com/docker/docker/pkg/archive"
+)
+
+// Returned for archives which aren't in a format we can read
+var errArchiveFormat = errors.New("not a docker save or OCI archive")
+
+// The annotation of an OCI index entry naming its tag
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// An image archive, as written by `docker save` or as an OCI image layout,
+// unpacked onto the explode volume. The layers of `docker save` archives
+// are uncompressed tars, named by their diff IDs; those of OCI archives are
+// blobs named by their digests, as in a registry.
+type imageArchive struct {
+	dir    string
+	images []archiveImage
+	// Layer digests, and the files holding them
+	blobs map[string]string
+}
+
+// An image within an archive
+type archiveImage struct {
+	// The digest of the image config, i.e. the image ID, for `docker save`
+	// archives, or of the manifest for OCI archives
+	ID       string
+	RepoTags []string
+	// Layer digests, bottom layer first
+	Layers []string
+	// The file holding the image config
+	Config string
+}
+
+// An entry of the manifest.json of a `docker save` archive
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// The index.json of an OCI image layout
+type ociIndex struct {
+	Manifests []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// Unpack an uncompressed image archive into a temporary directory on the
+// explode volume. The archive must be closed to remove it.
+func (wc *watchClient) unpackArchive(r io.Reader) (*imageArchive, error) {
+	dir, err := ioutil.TempDir(wc.OSTreeConfig.BasePath, ".archive-")
+	if err != nil {
+		return nil, err
+	}
+	a := &imageArchive{dir: dir, blobs: make(map[string]string)}
+
+	if err := dtar.UntarUncompressed(r, dir, nil); err != nil {
+		a.Close()
+		return nil, err
+	}
+	read := a.readDockerManifest
+	if _, err := os.Stat(path.Join(dir, "oci-layout")); err == nil {
+		read = a.readOCIIndex
+	}
+	if err := read(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Read the images of an unpacked `docker save` archive
+func (a *imageArchive) readDockerManifest() error {
+	raw, err := ioutil.ReadFile(path.Join(a.dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return errArchiveFormat
+	} else if err != nil {
+		return err
+	}
+	var manifests []dockerSaveManifest
+	if err := json.Unmarshal(raw, &manifests); err != nil {
+		return err
+	}
+
+	for _, m := range manifests {
+		id, err := a.digestFile(m.Config)
+		if err != nil {
+			return err
+		}
+		img := archiveImage{ID: id, RepoTags: m.RepoTags, Config: path.Join(a.dir, path.Clean("/"+m.Config))}
+		for _, layer := range m.Layers {
+			digest, err := a.digestFile(layer)
+			if err != nil {
+				return err
+			}
+			a.blobs[digest] = path.Join(a.dir, path.Clean("/"+layer))
+			img.Layers = append(img.Layers, digest)
+		}
+		a.images = append(a.images, img)
+	}
+	return nil
+}
+
+// Read the images of an unpacked OCI image layout. Only manifests listed in
+// its index.json are read, not those of nested indexes, and the digest of
+// each blob is checked.
+func (a *imageArchive) readOCIIndex() error {
+	raw, err := ioutil.ReadFile(path.Join(a.dir, "index.json"))
+	if os.IsNotExist(err) {
+		return errArchiveFormat
+	} else if err != nil {
+		return err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return err
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ociManifestMediaType && desc.MediaType != schema2MediaType {
+			continue
+		}
+		raw, err := a.readBlob(desc.Digest)
+		if err != nil {
+			return err
+		}
+		var manifest imageManifest
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return err
+		}
+		layers, err := manifest.layers()
+		if err != nil {
+			return err
+		}
+
+		img := archiveImage{ID: desc.Digest, Layers: layers}
+		if manifest.Config.Digest != "" {
+			config := path.Clean("/" + a.blobPath(manifest.Config.Digest))
+			if digest, err := a.digestFile(config); err != nil {
+				return err
+			} else if digest != manifest.Config.Digest {
+				return fmt.Errorf("config %s has digest %s", manifest.Config.Digest, digest)
+			}
+			img.Config = path.Join(a.dir, config)
+		}
+		if tag := desc.Annotations[ociRefNameAnnotation]; tag != "" {
+			img.RepoTags = []string{tag}
+		}
+		for _, layer := range layers {
+			blob := path.Clean("/" + a.blobPath(layer))
+			if digest, err := a.digestFile(blob); err != nil {
+				return err
+			} else if digest != layer {
+				return fmt.Errorf("layer %s has digest %s", layer, digest)
+			}
+			a.blobs[layer] = path.Join(a.dir, blob)
+		}
+		a.images = append(a.images, img)
+	}
+	if len(a.images) == 0 {
+		return errArchiveFormat
+	}
+	return nil
+}
+
+// Get the path of a blob within an OCI image layout
+func (a *imageArchive) blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// Read a blob of an OCI image layout, checking its digest
+func (a *imageArchive) readBlob(digest string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path.Join(a.dir, path.Clean("/"+a.blobPath(digest))))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(raw)
+	if "sha256:"+hex.EncodeToString(hash[:]) != digest {
+		return nil, fmt.Errorf("blob %s doesn't match its digest", digest)
+	}
+	return raw, nil
+}
+
+// Compute the digest of a file within the archive
+func (a *imageArchive) digestFile(name string) (string, error) {
+	file, err := os.Open(path.Join(a.dir, path.Clean("/"+name)))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Remove an unpacked archive
+func (a *imageArchive) Close() error {
+	return os.RemoveAll(a.dir)
+}
+
+// Make the images and layers of an archive available to explodeDigest
+func (wc *watchClient) registerArchive(a *imageArchive) {
+	wc.archivesMu.Lock()
+	defer wc.archivesMu.Unlock()
+	wc.archives = append(wc.archives, a)
+}
+
+// Stop serving the images and layers of an archive
+func (wc *watchClient) unregisterArchive(a *imageArchive) {
+	wc.archivesMu.Lock()
+	defer wc.archivesMu.Unlock()
+	for i, other := range wc.archives {
+		if other == a {
+			wc.archives = append(wc.archives[:i], wc.archives[i+1:]...)
+			return
+		}
+	}
+}
+
+// Look up the layers of an image in the registered archives
+func (wc *watchClient) archiveLayers(digest string) ([]string, bool) {
+	wc.archivesMu.Lock()
+	defer wc.archivesMu.Unlock()
+	for _, a := range wc.archives {
+		for _, img := range a.images {
+			if img.ID == digest {
+				return img.Layers, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Look up the file holding the config of an image in the registered
+// archives
+func (wc *watchClient) archiveConfig(digest string) (string, bool) {
+	wc.archivesMu.Lock()
+	defer wc.archivesMu.Unlock()
+	for _, a := range wc.archives {
+		for _, img := range a.images {
+			if img.ID == digest && img.Config != "" {
+				return img.Config, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Look up the file holding a layer in the registered archives
+func (wc *watchClient) archiveBlob(blob string) (string, bool) {
+	wc.archivesMu.Lock()
+	defer wc.archivesMu.Unlock()
+	for _, a := range wc.archives {
+		if p, ok := a.blobs[blob]; ok {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,64 @@
+package watchclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReadOCIIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write a blob of the layout, returning its digest
+	blob := func(content string) string {
+		hash := sha256.Sum256([]byte(content))
+		digest := "sha256:" + hex.EncodeToString(hash[:])
+		p := path.Join(dir, "blobs", strings.Replace(digest, ":", "/", 1))
+		os.MkdirAll(path.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	layer := blob("layer")
+	manifest := blob(`{"schemaVersion": 2, "layers": [{"digest": "` + layer + `"}]}`)
+	index := `{"manifests": [
+		{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:ffff"},
+		{"mediaType": "` + ociManifestMediaType + `", "digest": "` + manifest + `",
+		 "annotations": {"` + ociRefNameAnnotation + `": "v1"}}
+	]}`
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &imageArchive{dir: dir, blobs: make(map[string]string)}
+	if err := a.readOCIIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.images) != 1 {
+		t.Fatalf("Expected one image, got %+v", a.images)
+	}
+	img := a.images[0]
+	if img.ID != manifest || len(img.Layers) != 1 || img.Layers[0] != layer || len(img.RepoTags) != 1 || img.RepoTags[0] != "v1" {
+		t.Errorf("Unexpected image %+v", img)
+	}
+	if a.blobs[layer] != path.Join(dir, "blobs/sha256", strings.TrimPrefix(layer, "sha256:")) {
+		t.Errorf("Unexpected blob path %s", a.blobs[layer])
+	}
+
+	// A layer which doesn't match its digest is rejected
+	ioutil.WriteFile(a.blobs[layer], []byte("tampered"), 0644)
+	a = &imageArchive{dir: dir, blobs: make(map[string]string)}
+	if err := a.readOCIIndex(); err == nil {
+		t.Error("Tampered layer was accepted")
+	}
+}
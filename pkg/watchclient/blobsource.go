@@ -0,0 +1,155 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Open a layer blob of the given repository (<namespace>/<name>) for
+// reading. Local registry storage is read in place; remote registries are
+// streamed over the registry API without landing on disk. Layers of image
+// archives being exploded are read from where the archive was unpacked.
+func (wc *watchClient) openBlob(repository, blob string) (io.ReadCloser, error) {
+	if p, ok := wc.archiveBlob(blob); ok {
+		return os.Open(p)
+	}
+	source, repository := wc.blobSourceFor(repository)
+	switch source.Scheme {
+	case "file":
+		return os.Open(wc.localBlobPath(blob))
+	case "http", "https":
+		return wc.fetch(source, path.Join("v2", repository, "blobs", blob), nil)
+	}
+	return nil, fmt.Errorf("BlobSource scheme %q not implemented", source.Scheme)
+}
+
+// Get the path of a blob in local registry storage
+func (wc *watchClient) localBlobPath(blob string) string {
+	comp := strings.SplitN(blob, ":", 2)
+	// TODO: ugh
+	blobpath := strings.Join(comp, "/"+comp[1][:2]+"/")
+	return path.Join(wc.getBlobPath(), blobpath, "data")
+}
+
+// Open the manifest of an image of the given repository (<namespace>/<name>)
+// by digest. Local registry storage keeps manifests alongside the blobs.
+func (wc *watchClient) openManifest(repository, digest string) (io.ReadCloser, error) {
+	source, repository := wc.blobSourceFor(repository)
+	switch source.Scheme {
+	case "file":
+		return os.Open(wc.localBlobPath(digest))
+	case "http", "https":
+		return wc.fetch(source, path.Join("v2", repository, "manifests", digest), manifestMediaTypes)
+	}
+	return nil, fmt.Errorf("BlobSource scheme %q not implemented", source.Scheme)
+}
+
+// Get the digest of the manifest a tag of the given repository
+// (<namespace>/<name>) points at. Local registry storage links it from the
+// repository's tag; a remote registry reports it when the manifest is
+// fetched.
+func (wc *watchClient) manifestDigest(repository, tag string) (string, error) {
+	source, repository := wc.blobSourceFor(repository)
+	switch source.Scheme {
+	case "file":
+		link := path.Join(source.Path, "docker/registry/v2/repositories", repository, "_manifests/tags", tag, "current/link")
+		if digest := readLink(link); digest != "" {
+			return digest, nil
+		}
+		return "", fmt.Errorf("no tag %s in repository %s", tag, repository)
+	case "http", "https":
+		resp, err := wc.get(source, path.Join("v2", repository, "manifests", tag), manifestMediaTypes)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		return "", fmt.Errorf("registry reported no digest for %s:%s", repository, tag)
+	}
+	return "", fmt.Errorf("BlobSource scheme %q not implemented", source.Scheme)
+}
+
+// Determine whether a repository is named along with its registry host, as
+// images from other registries are, e.g. docker.io/library/fedora
+func hasRegistryHost(repository string) bool {
+	host := strings.SplitN(repository, "/", 2)[0]
+	return strings.Contains(repository, "/") &&
+		(strings.ContainsAny(host, ".:") || host == "localhost")
+}
+
+// Pick the source to read the blobs of a repository from, and the name of
+// the repository there. Repositories of other registries are read from the
+// pod registry source, with their host dropped.
+func (wc *watchClient) blobSourceFor(repository string) (*url.URL, string) {
+	if wc.PodRegistrySource != nil && hasRegistryHost(repository) {
+		return wc.PodRegistrySource, strings.SplitN(repository, "/", 2)[1]
+	}
+	return wc.BlobSource, repository
+}
+
+// Fetch a path of a remote registry's API, see get
+func (wc *watchClient) fetch(source *url.URL, apipath string, accept []string) (io.ReadCloser, error) {
+	resp, err := wc.get(source, apipath, accept)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Issue a GET on a path of a remote registry's API. Only the blob source,
+// the integrated registry, is sent our token; the pod registry source may
+// be a third-party mirror, so it is only sent credentials of its own, if
+// any. Only successful responses are returned.
+func (wc *watchClient) get(source *url.URL, apipath string, accept []string) (*http.Response, error) {
+	u := *source
+	u.Path = path.Join(u.Path, apipath)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mediatype := range accept {
+		req.Header.Add("Accept", mediatype)
+	}
+	switch {
+	case source == wc.BlobSource && wc.Token != "":
+		req.SetBasicAuth("exploder", wc.Token)
+	case source == wc.PodRegistrySource && wc.PodRegistryAuth != nil:
+		password, _ := wc.PodRegistryAuth.Password()
+		req.SetBasicAuth(wc.PodRegistryAuth.Username(), password)
+	}
+
+	resp, err := wc.BlobClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not fetch %s: %s", u.String(), resp.Status)
+	}
+	return resp, nil
+}
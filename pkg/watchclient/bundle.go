@@ -0,0 +1,363 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+// The OCI runtime config written next to each rootfs, which makes the
+// digest directory a bundle runc can run
+const runtimeConfigFile = "config.json"
+
+// The version of the OCI runtime spec the config follows
+const runtimeSpecVersion = "1.0.0"
+
+// The environment of processes whose image sets no PATH
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// The capabilities `runc spec` grants
+var defaultCapabilities = []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+// The parts of the OCI runtime spec we write. Only runc's libcontainer
+// configs are vendored, which are not the format of config.json.
+type runtimeSpec struct {
+	Version string         `json:"ociVersion"`
+	Process runtimeProcess `json:"process"`
+	Root    runtimeRoot    `json:"root"`
+	Mounts  []runtimeMount `json:"mounts"`
+	Linux   runtimeLinux   `json:"linux"`
+}
+
+type runtimeProcess struct {
+	Terminal        bool                `json:"terminal"`
+	User            runtimeUser         `json:"user"`
+	Args            []string            `json:"args"`
+	Env             []string            `json:"env"`
+	Cwd             string              `json:"cwd"`
+	Capabilities    runtimeCapabilities `json:"capabilities"`
+	Rlimits         []runtimeRlimit     `json:"rlimits"`
+	NoNewPrivileges bool                `json:"noNewPrivileges"`
+}
+
+type runtimeUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type runtimeCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+	Ambient     []string `json:"ambient"`
+}
+
+type runtimeRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type runtimeRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type runtimeMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type runtimeLinux struct {
+	Resources struct {
+		Devices []runtimeDeviceRule `json:"devices"`
+	} `json:"resources"`
+	Namespaces    []runtimeNamespace `json:"namespaces"`
+	MaskedPaths   []string           `json:"maskedPaths"`
+	ReadonlyPaths []string           `json:"readonlyPaths"`
+}
+
+type runtimeDeviceRule struct {
+	Allow  bool   `json:"allow"`
+	Access string `json:"access"`
+}
+
+type runtimeNamespace struct {
+	Type string `json:"type"`
+}
+
+// The part of a Docker or OCI image config, or of a schema1 v1Compatibility
+// entry, which tells how to run the image
+type imageRunConfig struct {
+	Config *imageapi.DockerConfig `json:"config"`
+}
+
+// Parse the run config out of an image config
+func parseRunConfig(raw []byte) (*imageapi.DockerConfig, error) {
+	var rc imageRunConfig
+	if err := json.Unmarshal(raw, &rc); err != nil {
+		return nil, err
+	}
+	if rc.Config == nil {
+		return &imageapi.DockerConfig{}, nil
+	}
+	return rc.Config, nil
+}
+
+// Get the run config of an image (Entrypoint, Cmd, Env, User, WorkingDir),
+// from wherever its layers are read from
+func (wc *watchClient) imageConfig(repository, digest string) (*imageapi.DockerConfig, error) {
+	if p, ok := wc.archiveConfig(digest); ok {
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return parseRunConfig(raw)
+	}
+	if wc.Client == nil || hasRegistryHost(repository) {
+		return wc.manifestConfig(repository, digest)
+	}
+
+	img, err := wc.getImage(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	if img.DockerImageConfig != "" {
+		return parseRunConfig([]byte(img.DockerImageConfig))
+	}
+	if img.DockerImageMetadata.Config == nil {
+		return &imageapi.DockerConfig{}, nil
+	}
+	return img.DockerImageMetadata.Config, nil
+}
+
+// Write digest/<alg>/<hex>/config.json, so that the digest directory is an
+// OCI runtime bundle running the image's process. The rootfs is read-only,
+// as its files are hardlinks into the OSTree repo.
+func (wc *watchClient) writeRuntimeConfig(repository, digest string) error {
+	config, err := wc.imageConfig(repository, digest)
+	if err != nil {
+		return err
+	}
+	spec, err := newRuntimeSpec(config, path.Join(wc.digestPath(digest), "rootfs"))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(wc.digestPath(digest), runtimeConfigFile), data, 0644)
+}
+
+// Build the runtime spec of an image from its run config, with the
+// defaults of `runc spec` otherwise. Users and groups named by the image
+// are looked up in the rootfs.
+func newRuntimeSpec(config *imageapi.DockerConfig, rootfs string) (*runtimeSpec, error) {
+	user, home, err := resolveUser(rootfs, config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(args) == 0 {
+		args = []string{"sh"}
+	}
+	env := config.Env
+	if !hasEnv(env, "PATH") {
+		env = append([]string{defaultPathEnv}, env...)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+home)
+	}
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	spec := &runtimeSpec{
+		Version: runtimeSpecVersion,
+		Process: runtimeProcess{
+			User: user,
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: runtimeCapabilities{
+				Bounding:    defaultCapabilities,
+				Effective:   defaultCapabilities,
+				Inheritable: defaultCapabilities,
+				Permitted:   defaultCapabilities,
+				Ambient:     defaultCapabilities,
+			},
+			Rlimits:         []runtimeRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root: runtimeRoot{Path: "rootfs", Readonly: true},
+		Mounts: []runtimeMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+	}
+	spec.Linux.Resources.Devices = []runtimeDeviceRule{{Allow: false, Access: "rwm"}}
+	for _, ns := range []string{"pid", "network", "ipc", "uts", "mount"} {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, runtimeNamespace{Type: ns})
+	}
+	spec.Linux.MaskedPaths = []string{"/proc/kcore", "/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware"}
+	spec.Linux.ReadonlyPaths = []string{"/proc/asound", "/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger"}
+	return spec, nil
+}
+
+// Determine whether an environment sets a variable
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve the user of an image (<user>[:<group>], each a name or an ID)
+// to IDs, along with its supplementary groups and home directory, as
+// Docker does. An empty user is root. Names must be in the rootfs'
+// /etc/passwd and /etc/group; unknown IDs are used as is.
+func resolveUser(rootfs, spec string) (runtimeUser, string, error) {
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	if name == "" {
+		name = "0"
+	}
+
+	user := runtimeUser{}
+	home := "/"
+	uid, err := strconv.ParseUint(name, 10, 32)
+	numeric := err == nil
+	user.UID = uint32(uid)
+	found := false
+	for _, entry := range readDatabase(rootfs, "/etc/passwd") {
+		// name:password:uid:gid:gecos:home:shell
+		if len(entry) < 7 || (numeric && entry[2] != name) || (!numeric && entry[0] != name) {
+			continue
+		}
+		id, err1 := strconv.ParseUint(entry[2], 10, 32)
+		gid, err2 := strconv.ParseUint(entry[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		user.UID, user.GID, home, name = uint32(id), uint32(gid), entry[5], entry[0]
+		found = true
+		break
+	}
+	if !numeric && !found {
+		return user, "", fmt.Errorf("no user %q in the image", name)
+	}
+
+	groups := readDatabase(rootfs, "/etc/group")
+	if group != "" {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			gid, err = lookupGroup(groups, group)
+			if err != nil {
+				return user, "", err
+			}
+		}
+		user.GID = uint32(gid)
+	}
+	if found {
+		// Supplementary groups, as only users with an entry have a name
+		for _, entry := range groups {
+			// name:password:gid:members
+			if len(entry) < 4 {
+				continue
+			}
+			gid, err := strconv.ParseUint(entry[2], 10, 32)
+			if err != nil || uint32(gid) == user.GID {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if member == name {
+					user.AdditionalGids = append(user.AdditionalGids, uint32(gid))
+					break
+				}
+			}
+		}
+	}
+	return user, home, nil
+}
+
+// Look up the ID of a group by name
+func lookupGroup(groups [][]string, name string) (uint64, error) {
+	for _, entry := range groups {
+		if len(entry) >= 3 && entry[0] == name {
+			return strconv.ParseUint(entry[2], 10, 32)
+		}
+	}
+	return 0, fmt.Errorf("no group %q in the image", name)
+}
+
+// Read the entries of a colon-separated database (e.g. /etc/passwd) of a
+// rootfs. As the image is untrusted, no symlink on the way is followed, so
+// that files outside the rootfs aren't read.
+func readDatabase(rootfs, name string) [][]string {
+	p := rootfs
+	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
+		p = path.Join(p, elem)
+		if info, err := os.Lstat(p); err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+	}
+	if info, err := os.Lstat(p); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
@@ -0,0 +1,72 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestNewRuntimeSpec(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "bundle-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	ioutil.WriteFile(path.Join(rootfs, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n"), 0644)
+	ioutil.WriteFile(path.Join(rootfs, "etc/group"), []byte("root:x:0:\nwheel:x:10:app\napp:x:1000:\n"), 0644)
+
+	config, err := parseRunConfig([]byte(`{"architecture": "amd64", "config": {
+		"User": "app", "Env": ["FOO=bar"], "Entrypoint": ["/entrypoint.sh"],
+		"Cmd": ["serve", "--port=8080"], "WorkingDir": "/srv"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := newRuntimeSpec(config, rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := spec.Process
+	if !reflect.DeepEqual(process.Args, []string{"/entrypoint.sh", "serve", "--port=8080"}) {
+		t.Errorf("Expected the Entrypoint followed by the Cmd, got %v", process.Args)
+	}
+	if !reflect.DeepEqual(process.Env, []string{defaultPathEnv, "FOO=bar", "HOME=/home/app"}) {
+		t.Errorf("Expected a default PATH and HOME, got %v", process.Env)
+	}
+	if process.Cwd != "/srv" || !spec.Root.Readonly || spec.Root.Path != "rootfs" {
+		t.Errorf("Unexpected cwd %s or root %+v", process.Cwd, spec.Root)
+	}
+	if !reflect.DeepEqual(process.User, runtimeUser{UID: 1000, GID: 1000, AdditionalGids: []uint32{10}}) {
+		t.Errorf("Unexpected user %+v", process.User)
+	}
+
+	users := map[string]runtimeUser{
+		"":           {},
+		"root":       {},
+		"1000:wheel": {UID: 1000, GID: 10},
+		"5000":       {UID: 5000},
+		"5000:5000":  {UID: 5000, GID: 5000},
+	}
+	for spec, expected := range users {
+		user, _, err := resolveUser(rootfs, spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+		} else if !reflect.DeepEqual(user, expected) {
+			t.Errorf("%q: expected %+v, got %+v", spec, expected, user)
+		}
+	}
+	for _, spec := range []string{"nobody", "app:nogroup"} {
+		if _, _, err := resolveUser(rootfs, spec); err == nil {
+			t.Errorf("%q: expected an unknown name to be refused", spec)
+		}
+	}
+
+	// A symlinked /etc must not be followed out of the rootfs
+	os.RemoveAll(path.Join(rootfs, "etc"))
+	os.Symlink("/etc", path.Join(rootfs, "etc"))
+	if _, _, err := resolveUser(rootfs, "root"); err == nil {
+		t.Error("Expected /etc/passwd not to be read through a symlink")
+	}
+}
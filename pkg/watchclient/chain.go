@@ -0,0 +1,88 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	ostree "github.com/14rcole/ostree-go/pkg/otbuiltin"
+)
+
+// Compute an ID for every layer prefix of an image, chained like the OCI
+// image spec's chain IDs: the ID of the first layer is its digest, and each
+// following one is the digest of "<parent ID> <layer digest>". Unlike OCI
+// chain IDs, they are computed from the (compressed) blob digests rather
+// than the diff IDs, which schema1 images don't list and which are only
+// known once a layer is decompressed, while the prefix must be looked up
+// before. The same layers compressed differently don't share a prefix.
+func chainIDs(layers []string) []string {
+	ids := make([]string, len(layers))
+	for i, layer := range layers {
+		if i == 0 {
+			ids[i] = layer
+			continue
+		}
+		sum := sha256.Sum256([]byte(ids[i-1] + " " + layer))
+		ids[i] = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return ids
+}
+
+// Produce the OSTree branch holding the rootfs state of a layer prefix
+func chainBranch(chainID string) string {
+	return "chain/" + strings.Join(strings.SplitN(chainID, ":", 2), "/")
+}
+
+// Find the longest layer prefix whose rootfs state is stored in the repo.
+// Returns the number of layers in the prefix and its commit, or 0 if there
+// is nothing to start from.
+func (wc *watchClient) longestStoredPrefix(chain []string) (int, string) {
+	for k := len(chain); k > 0; k-- {
+		if commit, err := wc.resolveBranch(chainBranch(chain[k-1])); err == nil {
+			return k, commit
+		}
+	}
+	return 0, ""
+}
+
+// Get the commit a branch points to. The bindings have no rev-parse, but
+// in a bare repo the ref is just a file under refs/heads.
+func (wc *watchClient) resolveBranch(branch string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(wc.OSTreeConfig.FullPath, "refs", "heads", branch))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Store the rootfs state after a layer prefix so that later images sharing
+// the prefix can start from it. The rootfs is a checkout of the repo, so
+// hardlinked files are recognized instead of being checksummed again.
+func (wc *watchClient) commitPrefix(rootfs, chainID string) (string, error) {
+	commitCfg := ostree.NewCommitOptions()
+	commitCfg.LinkCheckoutSpeedup = true
+	commitCfg.NoXattrs = false
+	commitCfg.Fsync = false
+	wc.ostreeLock.Lock()
+	defer wc.ostreeLock.Unlock()
+	return ostree.Commit(wc.OSTreeConfig.FullPath, rootfs, chainBranch(chainID), commitCfg)
+}
@@ -0,0 +1,35 @@
+package watchclient
+
+import (
+	"testing"
+)
+
+func TestChainIDsSharedPrefix(t *testing.T) {
+	a := chainIDs([]string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc"})
+	b := chainIDs([]string{"sha256:aaaa", "sha256:bbbb", "sha256:dddd"})
+
+	if a[0] != "sha256:aaaa" {
+		t.Errorf("Chain ID of the first layer should be its digest, got %s", a[0])
+	}
+	if a[1] != b[1] {
+		t.Error("Chain IDs of a shared prefix differ")
+	}
+	if a[2] == b[2] {
+		t.Error("Chain IDs of different top layers are equal")
+	}
+}
+
+func TestChainIDsOrder(t *testing.T) {
+	a := chainIDs([]string{"sha256:aaaa", "sha256:bbbb"})
+	b := chainIDs([]string{"sha256:bbbb", "sha256:aaaa"})
+
+	if a[1] == b[1] {
+		t.Error("Chain IDs should depend on layer order")
+	}
+}
+
+func TestChainBranch(t *testing.T) {
+	if branch := chainBranch("sha256:abcd"); branch != "chain/sha256/abcd" {
+		t.Errorf("Unexpected branch %s", branch)
+	}
+}
@@ -0,0 +1,232 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// The directory of the explode volume holding resourceVersion checkpoints
+const checkpointDir = ".checkpoints"
+
+// Get the checkpoint file of the informer of a namespace (or of all)
+func (wc *watchClient) checkpointPath(namespace string) string {
+	if namespace == kapi.NamespaceAll {
+		// Not a valid namespace name, so it can't clash with one
+		namespace = "_all"
+	}
+	return path.Join(wc.OSTreeConfig.BasePath, checkpointDir, namespace)
+}
+
+// Read the last resourceVersion processed by the informer of a namespace,
+// or "" if there is none
+func (wc *watchClient) readCheckpoint(namespace string) string {
+	rv, err := ioutil.ReadFile(wc.checkpointPath(namespace))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(rv))
+}
+
+// Record a processed resourceVersion for the informer of a namespace,
+// unless a later one is recorded already. The file is replaced atomically.
+func (wc *watchClient) writeCheckpoint(namespace, rv string) {
+	wc.checkpointMu.Lock()
+	defer wc.checkpointMu.Unlock()
+
+	if rv == "" || !resourceVersionAfter(rv, wc.readCheckpoint(namespace)) {
+		return
+	}
+
+	cpath := wc.checkpointPath(namespace)
+	os.MkdirAll(path.Dir(cpath), 0755)
+	tmp := cpath + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(rv), 0644)
+	if err == nil {
+		err = os.Rename(tmp, cpath)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"err":       err,
+		}).Warn("Could not write checkpoint")
+	}
+}
+
+// Determine whether a resourceVersion is later than another. They are
+// opaque, but numeric in practice; any other value is taken to be later.
+func resourceVersionAfter(rv, than string) bool {
+	a, aerr := strconv.ParseUint(rv, 10, 64)
+	b, berr := strconv.ParseUint(than, 10, 64)
+	if aerr != nil || berr != nil {
+		return rv != than
+	}
+	return a > b
+}
+
+// Determine whether the server reported a resourceVersion as too old
+func isGone(err error) bool {
+	status, ok := err.(kerrors.APIStatus)
+	return ok && status.Status().Code == http.StatusGone
+}
+
+// Resumes the ImageStream watch of a namespace from its checkpoint
+// instead of listing. Only the first list without a checkpoint, and lists
+// after the server answered 410 Gone, actually list; each actual list is
+// followed by a reconciliation. Resumed lists hand back what the informer
+// has cached, so that nothing is taken to be deleted.
+type resumingWatch struct {
+	wc        *watchClient
+	namespace string
+	// The informer's cached ImageStreams
+	cached func() []interface{}
+
+	mu     sync.Mutex
+	resume bool
+	// The resourceVersion of the last actual list
+	listRV string
+	// Events the handlers have processed, oldest first, down to the oldest
+	// one whose explodes still run
+	inflight []*inflightEvent
+}
+
+// An event the handlers have processed, whose explodes may still run
+type inflightEvent struct {
+	rv   string
+	done bool
+}
+
+func newResumingWatch(wc *watchClient, namespace string) *resumingWatch {
+	return &resumingWatch{wc: wc, namespace: namespace, resume: true}
+}
+
+// Build the ListWatch for the informer
+func (r *resumingWatch) listWatch() *cache.ListWatch {
+	return &cache.ListWatch{ListFunc: r.list, WatchFunc: r.watch}
+}
+
+func (r *resumingWatch) list(opts kapi.ListOptions) (runtime.Object, error) {
+	r.mu.Lock()
+	resume := r.resume
+	r.mu.Unlock()
+
+	if rv := r.wc.readCheckpoint(r.namespace); resume && rv != "" {
+		list := &imageapi.ImageStreamList{ListMeta: unversioned.ListMeta{ResourceVersion: rv}}
+		for _, obj := range r.cached() {
+			list.Items = append(list.Items, *obj.(*imageapi.ImageStream))
+		}
+		return list, nil
+	}
+
+	opts.LabelSelector = r.wc.LabelSelector
+	list, err := r.wc.Client.ImageStreams(r.namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.resume = true
+	r.listRV = list.ResourceVersion
+	r.mu.Unlock()
+	go r.wc.reconcile(r.namespace, list.Items)
+	return list, nil
+}
+
+func (r *resumingWatch) watch(opts kapi.ListOptions) (watch.Interface, error) {
+	opts.LabelSelector = r.wc.LabelSelector
+	w, err := r.wc.Client.ImageStreams(r.namespace).Watch(opts)
+	if err != nil {
+		if isGone(err) {
+			r.relist()
+		}
+		return nil, err
+	}
+	return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+		if status, ok := event.Object.(*unversioned.Status); ok && event.Type == watch.Error && status.Code == http.StatusGone {
+			r.relist()
+		}
+		return event, true
+	}), nil
+}
+
+// Make the next list an actual one
+func (r *resumingWatch) relist() {
+	log.WithField("namespace", r.namespace).Warn("Checkpoint too old, relisting")
+	r.mu.Lock()
+	r.resume = false
+	r.mu.Unlock()
+}
+
+// Checkpoint the resourceVersion of an event the handlers have processed
+// once the explodes they started for it have finished, if any. Events are
+// checkpointed in order, so that the checkpoint never moves past an event
+// whose explode still runs: were the exploder to stop, the event would be
+// replayed. Items of an actual list come in no particular order, so they
+// aren't checkpointed; the first event after them is, and as the
+// informer's queue is FIFO, it comes once all of them have been processed.
+func (r *resumingWatch) processed(rv string, explodes *sync.WaitGroup) {
+	event := &inflightEvent{rv: rv}
+	r.mu.Lock()
+	r.inflight = append(r.inflight, event)
+	r.mu.Unlock()
+
+	if explodes == nil {
+		r.finished(event)
+		return
+	}
+	go func() {
+		explodes.Wait()
+		r.finished(event)
+	}()
+}
+
+// Mark an event as finished, and checkpoint the newest event which no
+// unfinished one precedes
+func (r *resumingWatch) finished(event *inflightEvent) {
+	r.mu.Lock()
+	event.done = true
+	var rv string
+	for len(r.inflight) > 0 && r.inflight[0].done {
+		rv = r.inflight[0].rv
+		r.inflight = r.inflight[1:]
+	}
+	listRV := r.listRV
+	r.mu.Unlock()
+
+	if rv == "" || (listRV != "" && !resourceVersionAfter(rv, listRV)) {
+		return
+	}
+	r.wc.writeCheckpoint(r.namespace, rv)
+}
@@ -0,0 +1,70 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestWriteCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+
+	if rv := wc.readCheckpoint("myproject"); rv != "" {
+		t.Errorf("Expected no checkpoint, got %q", rv)
+	}
+
+	for _, step := range []struct{ write, expected string }{
+		{"10", "10"},
+		{"9", "10"},
+		{"100", "100"},
+		{"", "100"},
+	} {
+		wc.writeCheckpoint("myproject", step.write)
+		if rv := wc.readCheckpoint("myproject"); rv != step.expected {
+			t.Errorf("After writing %q, expected %q, got %q", step.write, step.expected, rv)
+		}
+	}
+
+	if rv := wc.readCheckpoint(kapi.NamespaceAll); rv != "" {
+		t.Errorf("Checkpoints of namespaces leaked into all of them: %q", rv)
+	}
+}
+
+func TestProcessedWaitsForExplodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	r := newResumingWatch(wc, "myproject")
+
+	first := &sync.WaitGroup{}
+	first.Add(1)
+	r.processed("10", first)
+	r.processed("11", nil)
+	if rv := wc.readCheckpoint("myproject"); rv != "" {
+		t.Errorf("Checkpointed %q before the explode of 10 finished", rv)
+	}
+
+	first.Done()
+	for i := 0; i < 100 && wc.readCheckpoint("myproject") == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rv := wc.readCheckpoint("myproject"); rv != "11" {
+		t.Errorf("Expected 11 to be checkpointed, got %q", rv)
+	}
+}
@@ -0,0 +1,154 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Watch the local Docker daemon's events, exploding images as they are
+// pulled, tagged (which includes builds), imported or loaded
+func (wc *watchClient) WatchDocker() {
+	listener := make(chan *docker.APIEvents, 16)
+	if err := wc.DockerClient.AddEventListener(listener); err != nil {
+		wc.Logger.WithField("err", err).Fatal("Could not listen for Docker events")
+	}
+
+	wc.Logger.Info("Watching Docker events...")
+	for event := range listener {
+		if name, action, ok := dockerImageEvent(event); ok {
+			go wc.DockerImageChanged(name, action)
+		}
+	}
+	wc.Logger.Fatal("Docker event stream closed")
+}
+
+// Get the image a Docker event is about and the event's action, if it is
+// one which can bring an image into existence
+func dockerImageEvent(event *docker.APIEvents) (string, string, bool) {
+	action, name := event.Action, event.Actor.ID
+	if event.Type == "" {
+		// Daemons before API 1.22
+		action, name = event.Status, event.ID
+	} else if event.Type != "image" {
+		return "", "", false
+	}
+
+	switch action {
+	case "pull", "tag", "import", "load":
+		return name, action, name != ""
+	}
+	return "", "", false
+}
+
+// Split a Docker repo tag (e.g. registry:5000/ns/app:v1) into an image
+// reference (registry:5000/ns/app/v1)
+func dockerRef(repotag string) (string, bool) {
+	i := strings.LastIndex(repotag, ":")
+	if i < 0 || strings.Contains(repotag[i:], "/") || repotag == "<none>:<none>" {
+		return "", false
+	}
+	return path.Join(repotag[:i], repotag[i+1:]), true
+}
+
+// Handle an image of the Docker daemon, by name or ID, which may be new:
+// explode it if it isn't yet, and point the refs of its tags at it. The
+// Docker event's action is recorded as what triggered the refs' update.
+func (wc *watchClient) DockerImageChanged(name, action string) {
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType": "DOCKER",
+		"image":     name,
+		"trigger":   action,
+	})
+
+	img, err := wc.DockerClient.InspectImage(name)
+	if err != nil {
+		ctxLogger.WithField("err", err).Error("Could not inspect image")
+		return
+	}
+	id := img.ID
+	if !strings.HasPrefix(id, "sha256:") {
+		id = "sha256:" + id
+	}
+
+	// Exporting is expensive, so only one export of an image runs at once
+	unlock := wc.lockDigest("docker:" + id)
+	defer unlock()
+
+	if _, err := os.Stat(path.Join(wc.digestPath(id), "rootfs")); err != nil {
+		ctxLogger.WithField("id", id).Info("New image")
+		if err := wc.explodeDockerImage(id); err != nil {
+			ctxLogger.WithField("err", err).Error("Could not export image (IMAGE POISONED)")
+			return
+		}
+	}
+
+	for _, repotag := range img.RepoTags {
+		imgref, ok := dockerRef(repotag)
+		link := path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link")
+		if !ok || readLink(link) == id {
+			continue
+		}
+		if err := wc.updateRef(imgref, id); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"tag": repotag,
+				"err": err,
+			}).Error("Failed to update reference")
+			continue
+		}
+		md := &refMetadata{Digest: id, Trigger: action, Updated: time.Now().UTC()}
+		if err := wc.writeRefMetadata(imgref, md); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"tag": repotag,
+				"err": err,
+			}).Warn("Could not write reference metadata")
+		}
+		ctxLogger.WithField("tag", repotag).Info("New tag")
+	}
+}
+
+// Export an image from the Docker daemon and explode it under its ID
+func (wc *watchClient) explodeDockerImage(id string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(wc.DockerClient.ExportImage(docker.ExportImageOptions{
+			Name:         id,
+			OutputStream: w,
+		}))
+	}()
+
+	a, err := wc.unpackArchive(r)
+	// Unblocks the export, should unpacking have stopped early
+	r.Close()
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	wc.registerArchive(a)
+	defer wc.unregisterArchive(a)
+	return wc.explodeDigest("", id)
+}
@@ -0,0 +1,41 @@
+package watchclient
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestDockerRef(t *testing.T) {
+	cases := map[string]string{
+		"fedora:latest":                  "fedora/latest",
+		"registry:5000/myproject/app:v1": "registry:5000/myproject/app/v1",
+		"registry:5000/myproject/app":    "",
+		"<none>:<none>":                  "",
+	}
+	for repotag, expected := range cases {
+		imgref, ok := dockerRef(repotag)
+		if ok != (expected != "") || imgref != expected {
+			t.Errorf("dockerRef(%q) = %q, %v", repotag, imgref, ok)
+		}
+	}
+}
+
+func TestDockerImageEvent(t *testing.T) {
+	events := []struct {
+		event  *docker.APIEvents
+		name   string
+		action string
+	}{
+		{&docker.APIEvents{Type: "image", Action: "pull", Actor: docker.APIActor{ID: "fedora:latest"}}, "fedora:latest", "pull"},
+		{&docker.APIEvents{Type: "image", Action: "delete", Actor: docker.APIActor{ID: "sha256:aaaa"}}, "", ""},
+		{&docker.APIEvents{Type: "container", Action: "create", Actor: docker.APIActor{ID: "cccc"}}, "", ""},
+		{&docker.APIEvents{Status: "tag", ID: "sha256:aaaa"}, "sha256:aaaa", "tag"},
+	}
+	for _, e := range events {
+		name, action, ok := dockerImageEvent(e.event)
+		if ok != (e.name != "") || name != e.name || action != e.action {
+			t.Errorf("dockerImageEvent(%+v) = %q, %q, %v", e.event, name, action, ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+// Set to "true" or "false" on an ImageStream, or on a Project to set the
+// default for its streams, to opt in or out of explosion
+const enabledAnnotation = "exploder.openshift.io/enabled"
+
+// Set to a comma-separated list of globs on an ImageStream, or on a Project
+// to set the default for its streams, to explode only the matching tags
+const tagsAnnotation = "exploder.openshift.io/tags"
+
+// How long the annotations of a Project are cached for
+const namespaceAnnotationsTTL = time.Minute
+
+// The annotations of a Project, as of when they were fetched
+type namespaceAnnotations struct {
+	annotations map[string]string
+	fetched     time.Time
+}
+
+// Get the annotations of a namespace's Project. Projects we can't read are
+// treated as having no annotations.
+func (wc *watchClient) namespaceAnnotations(namespace string) map[string]string {
+	wc.namespaceCacheMu.Lock()
+	defer wc.namespaceCacheMu.Unlock()
+
+	if wc.namespaceCache == nil {
+		wc.namespaceCache = make(map[string]namespaceAnnotations)
+	}
+	if cached, ok := wc.namespaceCache[namespace]; ok && time.Since(cached.fetched) < namespaceAnnotationsTTL {
+		return cached.annotations
+	}
+
+	var annotations map[string]string
+	project, err := wc.Client.Projects().Get(namespace)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"namespace": namespace,
+			"err":       err,
+		}).Debug("Could not get project annotations")
+	} else {
+		annotations = project.Annotations
+	}
+	wc.namespaceCache[namespace] = namespaceAnnotations{annotations, time.Now()}
+	return annotations
+}
+
+// Look up an annotation on an ImageStream, falling back to its Project
+func (wc *watchClient) streamAnnotation(is *imageapi.ImageStream, key string) (string, bool) {
+	if value, ok := is.Annotations[key]; ok {
+		return value, true
+	}
+	value, ok := wc.namespaceAnnotations(is.Namespace)[key]
+	return value, ok
+}
+
+// Determine whether an ImageStream is to be exploded at all
+func (wc *watchClient) streamEnabled(is *imageapi.ImageStream) bool {
+	if value, ok := wc.streamAnnotation(is, enabledAnnotation); ok {
+		return value == "true"
+	}
+	return !wc.OptIn
+}
+
+// Determine whether a tag of an ImageStream is to be exploded
+func (wc *watchClient) tagEnabled(is *imageapi.ImageStream, tag string) bool {
+	value, ok := wc.streamAnnotation(is, tagsAnnotation)
+	if !ok {
+		return true
+	}
+	return tagMatches(value, tag)
+}
+
+// Match a tag against a comma-separated list of globs
+func tagMatches(patterns, tag string) bool {
+	return matchesAny(splitList(patterns), tag)
+}
+
+// Determine whether the explosion annotations of an ImageStream changed
+func filterChanged(old, is *imageapi.ImageStream) bool {
+	return old.Annotations[enabledAnnotation] != is.Annotations[enabledAnnotation] ||
+		old.Annotations[tagsAnnotation] != is.Annotations[tagsAnnotation]
+}
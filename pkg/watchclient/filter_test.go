@@ -0,0 +1,23 @@
+package watchclient
+
+import "testing"
+
+func TestTagMatches(t *testing.T) {
+	cases := []struct {
+		patterns string
+		tag      string
+		match    bool
+	}{
+		{"latest", "latest", true},
+		{"latest", "stable", false},
+		{"v1.*", "v1.2", true},
+		{"v1.*", "v2.0", false},
+		{"latest, v*", "v2.0", true},
+		{"", "latest", false},
+	}
+	for _, c := range cases {
+		if tagMatches(c.patterns, c.tag) != c.match {
+			t.Errorf("tagMatches(%q, %q) should be %v", c.patterns, c.tag, c.match)
+		}
+	}
+}
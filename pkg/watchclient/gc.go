@@ -0,0 +1,146 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const defaultGCKeepYoungerThan = time.Hour
+
+// The outcome of a garbage collection of the OSTree repo
+type gcResult struct {
+	RefsDeleted    int
+	ObjectsPruned  int
+	BytesReclaimed int64
+}
+
+// Apply the retention policies, then collect garbage, every GCInterval
+// until the process exits
+func (wc *watchClient) RunGC() {
+	for range time.Tick(wc.GCInterval) {
+		wc.ApplyRetention(false)
+		wc.GC()
+	}
+}
+
+// Delete the OSTree refs no exploded image needs anymore, unless they were
+// written within GCKeepYoungerThan, then prune the objects no ref reaches.
+// Layer commits only stay reachable until the next layer of their image is
+// committed, so explodes are held off while the repo is pruned.
+func (wc *watchClient) GC() (*gcResult, error) {
+	ctxLogger := log.WithField("eventType", "GC")
+
+	wc.gcLock.Lock()
+	defer wc.gcLock.Unlock()
+
+	result := &gcResult{}
+	live := wc.liveBranches()
+	headspath := path.Join(wc.OSTreeConfig.FullPath, "refs", "heads")
+	cutoff := time.Now().Add(-wc.GCKeepYoungerThan)
+	filepath.Walk(headspath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		branch := strings.TrimPrefix(p, headspath+"/")
+		// Refs we didn't write are none of our business
+		if !strings.HasPrefix(branch, "oci/") && !strings.HasPrefix(branch, "chain/") {
+			return nil
+		}
+		if live[branch] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"branch": branch,
+				"err":    err,
+			}).Warn("Could not delete ref")
+			return nil
+		}
+		removeEmptyParents(path.Dir(p), headspath)
+		result.RefsDeleted++
+		return nil
+	})
+
+	before := wc.repoObjects()
+	out, err := exec.Command("ostree", "prune", "--repo="+wc.OSTreeConfig.FullPath, "--refs-only").CombinedOutput()
+	if err != nil {
+		ctxLogger.WithFields(log.Fields{
+			"err":    err,
+			"output": strings.TrimSpace(string(out)),
+		}).Error("Could not prune repo")
+		return result, err
+	}
+	for p, info := range before {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			continue
+		}
+		result.ObjectsPruned++
+		// Objects hardlinked into a checkout only free space with it
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+			result.BytesReclaimed += info.Size()
+		}
+	}
+
+	ctxLogger.WithFields(log.Fields{
+		"refs":    result.RefsDeleted,
+		"objects": result.ObjectsPruned,
+		"bytes":   result.BytesReclaimed,
+	}).Info("Collected garbage")
+	return result, nil
+}
+
+// Collect the branches the exploded images need: their own, and those of
+// every layer prefix they may share with the next image
+func (wc *watchClient) liveBranches() map[string]bool {
+	live := make(map[string]bool)
+	digestpath := path.Join(wc.OSTreeConfig.BasePath, "digest")
+	for _, alg := range subdirs(digestpath) {
+		for _, hex := range subdirs(path.Join(digestpath, alg)) {
+			live[path.Join("oci", alg, hex)] = true
+			md, err := wc.readImageMetadata(alg + ":" + hex)
+			if err != nil {
+				continue
+			}
+			for _, id := range chainIDs(md.Layers) {
+				live[chainBranch(id)] = true
+			}
+		}
+	}
+	return live
+}
+
+// List the object files of the repo
+func (wc *watchClient) repoObjects() map[string]os.FileInfo {
+	objects := make(map[string]os.FileInfo)
+	filepath.Walk(path.Join(wc.OSTreeConfig.FullPath, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			objects[p] = info
+		}
+		return nil
+	})
+	return objects
+}
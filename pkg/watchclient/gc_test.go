@@ -0,0 +1,43 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+func TestLiveBranches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	layers := []string{"sha256:1111", "sha256:2222"}
+	for _, digest := range []string{"sha256:aaaa", "sha256:bbbb"} {
+		if err := os.MkdirAll(wc.digestPath(digest), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bbbb predates metadata, so only its own branch is known
+	if err := wc.writeImageMetadata(&imageMetadata{Digest: "sha256:aaaa", Layers: layers}); err != nil {
+		t.Fatal(err)
+	}
+
+	live := wc.liveBranches()
+	expected := []string{"oci/sha256/aaaa", "oci/sha256/bbbb"}
+	for _, id := range chainIDs(layers) {
+		expected = append(expected, chainBranch(id))
+	}
+	if len(live) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, live)
+	}
+	for _, branch := range expected {
+		if !live[branch] {
+			t.Errorf("Branch %s isn't live", branch)
+		}
+	}
+}
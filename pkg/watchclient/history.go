@@ -0,0 +1,260 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+const defaultHistoryDepth = 1
+
+// Get the directory holding the history entries of an image reference
+func (wc *watchClient) historyPath(imgref string) string {
+	return path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "history")
+}
+
+// Split the name of a history entry into its generation and the suffix
+// telling apart images of the same generation
+func parseHistoryName(name string) (generation, n int64, err error) {
+	parts := strings.SplitN(name, ".", 2)
+	if generation, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 2 {
+		if n, err = strconv.ParseInt(parts[1], 10, 64); err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid history entry %s", name)
+		}
+	}
+	return generation, n, nil
+}
+
+// Sorts the names of history entries newest first: by generation, then by
+// suffix. Names which aren't those of entries come last.
+type historyOrder []string
+
+func (h historyOrder) Len() int      { return len(h) }
+func (h historyOrder) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h historyOrder) Less(i, j int) bool {
+	ag, an, aerr := parseHistoryName(h[i])
+	bg, bn, berr := parseHistoryName(h[j])
+	switch {
+	case aerr != nil || berr != nil:
+		return aerr == nil && berr != nil
+	case ag != bg:
+		return ag > bg
+	}
+	return an > bn
+}
+
+// List the digests of the history entries of an image reference, newest
+// first
+func (wc *watchClient) historyDigests(imgref string) []string {
+	histpath := wc.historyPath(imgref)
+	files, _ := ioutil.ReadDir(histpath)
+	var names historyOrder
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Sort(names)
+
+	var digests []string
+	for _, name := range names {
+		if digest := readLink(path.Join(histpath, name)); digest != "" {
+			digests = append(digests, digest)
+		}
+	}
+	return digests
+}
+
+// A history entry: the image it points to, and its name
+type historyEntry struct {
+	name  string
+	image string
+}
+
+// Name the distinct images of a tag which can be exploded, newest first,
+// after the generation of their newest event. Several images may share a
+// generation (e.g. several pushes between two imports); they are told apart
+// by a suffix counted from the oldest of them, <generation>, then
+// <generation>.1 and so on, so that the name of an image doesn't change as
+// newer events come in. An image the tag was moved back to takes the
+// generation of the move.
+func (wc *watchClient) historyEntries(events imageapi.TagEventList) []historyEntry {
+	var images []imageapi.TagEvent
+	seen := make(map[string]bool)
+	for _, event := range events.Items {
+		if seen[event.Image] || !wc.explodable(event.DockerImageReference) {
+			continue
+		}
+		seen[event.Image] = true
+		images = append(images, event)
+	}
+
+	entries := make([]historyEntry, len(images))
+	shared := make(map[int64]int)
+	for i := len(images) - 1; i >= 0; i-- {
+		generation := images[i].Generation
+		name := strconv.FormatInt(generation, 10)
+		if n := shared[generation]; n > 0 {
+			name += "." + strconv.Itoa(n)
+		}
+		shared[generation]++
+		entries[i] = historyEntry{name: name, image: images[i].Image}
+	}
+	return entries
+}
+
+// Keep the newest HistoryDepth distinct images of a tag exploded, each
+// exposed as images/<ns>/<name>/<tag>/history/<generation> (see
+// historyEntries), and drop older entries. A depth of 1 keeps no history
+// besides the link. The retention policy of the namespace may lower the
+// depth, or keep the tag's images forever: then every image of the tag
+// still exploded keeps an entry, even once it is gone from the tag's
+// history.
+func (wc *watchClient) syncHistory(imgref string, events imageapi.TagEventList) {
+	policy := wc.retentionFor(strings.SplitN(imgref, "/", 2)[0])
+	forever := policy.keepsForever(path.Base(imgref))
+	depth := wc.HistoryDepth
+	if policy.KeepDigests > 0 && policy.KeepDigests < depth && !forever {
+		depth = policy.KeepDigests
+	}
+	if depth <= 1 {
+		depth = 0
+	}
+
+	ctxLogger := log.WithField("ref", imgref)
+	histpath := wc.historyPath(imgref)
+
+	all := wc.historyEntries(events)
+	wanted := all
+	if len(wanted) > depth {
+		wanted = wanted[:depth]
+	}
+	keep := make(map[string]bool)
+	for _, entry := range wanted {
+		keep[entry.name] = true
+	}
+	if forever {
+		seen := make(map[string]bool)
+		for _, entry := range wanted {
+			seen[entry.image] = true
+		}
+		for _, entry := range all[len(wanted):] {
+			if _, err := os.Stat(path.Join(wc.digestPath(entry.image), "rootfs")); err == nil {
+				seen[entry.image] = true
+				keep[entry.name] = true
+				wanted = append(wanted, entry)
+			}
+		}
+		// Entries of images gone from the tag's history keep their name
+		files, _ := ioutil.ReadDir(histpath)
+		for _, file := range files {
+			if digest := readLink(path.Join(histpath, file.Name())); digest != "" && !seen[digest] && !keep[file.Name()] {
+				seen[digest] = true
+				keep[file.Name()] = true
+			}
+		}
+	}
+
+	// Digests entries no longer point to, removed once nothing else does
+	var dropped []string
+	defer func() {
+		wc.removeUnreferencedDigests(dropped, ctxLogger)
+	}()
+
+	for _, entry := range wanted {
+		lpath := path.Join(histpath, entry.name)
+		old := readLink(lpath)
+		if old == entry.image {
+			continue
+		}
+		if err := wc.explodeForLink(path.Dir(imgref), entry.image, lpath); err != nil {
+			delete(keep, entry.name)
+			continue
+		}
+		if err := wc.setLink(lpath, entry.image); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"entry": entry.name,
+				"err":   err,
+			}).Error("Could not update history entry")
+			continue
+		}
+		if old != "" {
+			dropped = append(dropped, old)
+		}
+	}
+
+	files, err := ioutil.ReadDir(histpath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if keep[file.Name()] {
+			continue
+		}
+		lpath := path.Join(histpath, file.Name())
+		digest := readLink(lpath)
+		if err := wc.removeLink(lpath); err == nil && digest != "" {
+			dropped = append(dropped, digest)
+		}
+	}
+}
+
+// Sync the history of a tag in the background. Syncs of one tag run one at
+// a time, and each takes the newest events handed over by then, so that
+// an older list of events never wins over a newer one.
+func (wc *watchClient) queueHistorySync(imgref string, events imageapi.TagEventList) {
+	wc.historySyncsMu.Lock()
+	defer wc.historySyncsMu.Unlock()
+
+	if wc.historySyncs == nil {
+		wc.historySyncs = make(map[string]*imageapi.TagEventList)
+	}
+	_, running := wc.historySyncs[imgref]
+	wc.historySyncs[imgref] = &events
+	if !running {
+		go wc.runHistorySyncs(imgref)
+	}
+}
+
+// Sync the history of a tag until no newer events are queued for it
+func (wc *watchClient) runHistorySyncs(imgref string) {
+	for {
+		wc.historySyncsMu.Lock()
+		events := wc.historySyncs[imgref]
+		if events == nil {
+			delete(wc.historySyncs, imgref)
+			wc.historySyncsMu.Unlock()
+			return
+		}
+		wc.historySyncs[imgref] = nil
+		wc.historySyncsMu.Unlock()
+
+		wc.syncHistory(imgref, *events)
+	}
+}
@@ -0,0 +1,99 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+const testRegistry = "172.30.1.1:5000"
+
+// Build the history of a tag, newest first, from the generation and image
+// of each event
+func tagHistory(events ...string) imageapi.TagEventList {
+	var list imageapi.TagEventList
+	for i := 0; i < len(events); i += 2 {
+		generation, _ := strconv.ParseInt(events[i], 10, 64)
+		list.Items = append(list.Items, imageapi.TagEvent{
+			Generation:           generation,
+			Image:                events[i+1],
+			DockerImageReference: testRegistry + "/myproject/app@" + events[i+1],
+		})
+	}
+	return list
+}
+
+func TestHistoryEntries(t *testing.T) {
+	wc := &watchClient{Registry: testRegistry}
+	// Several pushes share a generation, and the tag was moved back to cccc
+	events := tagHistory("3", "sha256:dddd", "3", "sha256:cccc", "3", "sha256:bbbb", "2", "sha256:cccc", "1", "sha256:aaaa")
+	events.Items[2].DockerImageReference = "docker.io/library/pulled@sha256:bbbb"
+
+	entries := wc.historyEntries(events)
+	expected := []historyEntry{
+		{name: "3.1", image: "sha256:dddd"},
+		{name: "3", image: "sha256:cccc"},
+		{name: "1", image: "sha256:aaaa"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestSyncHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+		Registry:     testRegistry,
+		HistoryDepth: 3,
+	}
+	// Exploded already, so that syncHistory only links them
+	for _, digest := range []string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc", "sha256:dddd"} {
+		if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imgref := "myproject/app/latest"
+	histpath := wc.historyPath(imgref)
+	entries := func() map[string]string {
+		found := make(map[string]string)
+		files, _ := ioutil.ReadDir(histpath)
+		for _, file := range files {
+			found[file.Name()] = readLink(path.Join(histpath, file.Name()))
+		}
+		return found
+	}
+
+	wc.syncHistory(imgref, tagHistory("2", "sha256:bbbb", "2", "sha256:aaaa"))
+	wc.syncHistory(imgref, tagHistory("4", "sha256:dddd", "3", "sha256:cccc", "2", "sha256:bbbb", "2", "sha256:aaaa"))
+	// bbbb keeps its name as newer images come in
+	expected := map[string]string{"4": "sha256:dddd", "3": "sha256:cccc", "2.1": "sha256:bbbb"}
+	if found := entries(); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected the newest 3 images, got %v", found)
+	}
+	if _, err := os.Stat(wc.digestPath("sha256:aaaa")); !os.IsNotExist(err) {
+		t.Error("The image dropped from the history was kept")
+	}
+
+	// Lowering the depth to 1 drops the history
+	wc.HistoryDepth = 1
+	wc.syncHistory(imgref, tagHistory("4", "sha256:dddd", "3", "sha256:cccc"))
+	if found := entries(); len(found) != 0 {
+		t.Errorf("Expected no history entries, got %v", found)
+	}
+	if refs := wc.digestRefs("sha256:bbbb"); len(refs) != 0 {
+		t.Errorf("Dropped entries are still indexed: %v", refs)
+	}
+}
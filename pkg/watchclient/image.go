@@ -18,16 +18,16 @@
 package watchclient
 
 import (
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
-	dtar "github.com/docker/docker/pkg/archive"
-
 	ostree "github.com/14rcole/ostree-go/pkg/otbuiltin"
 
 	imageapi "github.com/openshift/origin/pkg/image/api"
@@ -40,28 +40,59 @@ import (
 	"k8s.io/kubernetes/pkg/watch"
 )
 
+// Returned once an explode has failed and been logged
+var errImagePoisoned = errors.New("image poisoned")
+
 // Determine if an image is a Pullthrough ref
 func (wc *watchClient) isPullthrough(ref string) bool {
 	return !strings.HasPrefix(ref, wc.Registry+"/")
 }
 
-// handle an ADDED image
-func (wc *watchClient) ImageAdded(is *imageapi.ImageStream) {
+// Determine whether an image can be exploded. Images stored in the
+// integrated registry always can; images it pulls through from other
+// registries, such as imported ones, can only be read over its API.
+func (wc *watchClient) explodable(ref string) bool {
+	return !wc.isPullthrough(ref) || (wc.BlobSource != nil && wc.BlobSource.Scheme != "file")
+}
+
+// handle an ADDED image. The informer's store starts out empty when its
+// watch resumes from a checkpoint, so streams it already saw before a
+// restart arrive as added too: refs of tags the stream no longer has are
+// removed as on an update. The returned WaitGroup tracks the explodes
+// started.
+func (wc *watchClient) ImageAdded(is *imageapi.ImageStream) *sync.WaitGroup {
 	ctxLogger := log.WithFields(log.Fields{
 		"eventType": "ADDED",
 		"image":     is.Status.DockerImageRepository,
 	})
+	explodes := &sync.WaitGroup{}
+
+	var stale []string
+	for _, tag := range wc.recordedTags(is.Namespace, is.Name) {
+		if _, ok := is.Status.Tags[tag]; !ok {
+			stale = append(stale, tag)
+		}
+	}
+	wc.removeTags(is, stale, ctxLogger)
+
 	tags := is.Status.Tags
 	if tags == nil {
 		ctxLogger.Debug("No tags.")
-		return
+		return explodes
+	}
+	if !wc.streamEnabled(is) {
+		ctxLogger.Debug("Explosion disabled.")
+		return explodes
 	}
 
 	for tag, events := range tags {
+		if !wc.tagEnabled(is, tag) {
+			continue
+		}
 		imgref := getFullRef(is, tag)
 		digest := events.Items[0].Image
 
-		if wc.isPullthrough(events.Items[0].DockerImageReference) {
+		if !wc.explodable(events.Items[0].DockerImageReference) {
 			ctxLogger.WithField("tag", imgref).Debug("Ignoring pullthrough.")
 			continue
 		}
@@ -69,31 +100,70 @@ func (wc *watchClient) ImageAdded(is *imageapi.ImageStream) {
 		curdigest := wc.digestForRef(imgref)
 
 		if digest != curdigest {
-			go wc.explode(imgref, digest)
-			ctxLogger.WithField("tag", tag).Info("New tag")
+			trigger := tagTrigger(is, tag)
+			wc.startExplode(explodes, imgref, digest, trigger)
+			ctxLogger.WithFields(log.Fields{
+				"tag":     tag,
+				"trigger": trigger,
+			}).Info("New tag")
+		}
+		wc.queueHistorySync(imgref, events)
+	}
+	return explodes
+}
+
+// Compare the tags of two versions of an ImageStream. Tags whose newest
+// image differs (including new tags) are changed; tags missing from the
+// new version are removed. Unchanged tags are in neither list.
+func diffTags(old, is *imageapi.ImageStream) (changed, removed []string) {
+	for tag, events := range is.Status.Tags {
+		if len(events.Items) == 0 {
+			continue
+		}
+		prev, ok := old.Status.Tags[tag]
+		if !ok || len(prev.Items) == 0 || prev.Items[0].Image != events.Items[0].Image {
+			changed = append(changed, tag)
 		}
 	}
+	for tag := range old.Status.Tags {
+		if _, ok := is.Status.Tags[tag]; !ok {
+			removed = append(removed, tag)
+		}
+	}
+	return changed, removed
 }
 
-// Handle an UPDATED image
-func (wc *watchClient) ImageUpdated(is *imageapi.ImageStream) {
+// Handle an UPDATED image. The returned WaitGroup tracks the explodes
+// started.
+func (wc *watchClient) ImageUpdated(old, is *imageapi.ImageStream) *sync.WaitGroup {
 	ctxLogger := log.WithFields(log.Fields{
 		"eventType": "UPDATED",
 		"image":     is.Status.DockerImageRepository,
 	})
-
-	tags := is.Status.Tags
-	if tags == nil {
-		ctxLogger.Error("No tags.")
-		return
+	explodes := &sync.WaitGroup{}
+
+	changed, removed := diffTags(old, is)
+	if filterChanged(old, is) {
+		// Tags which were filtered out before may now be wanted
+		changed = nil
+		for tag, events := range is.Status.Tags {
+			if len(events.Items) > 0 {
+				changed = append(changed, tag)
+			}
+		}
 	}
 
-	for tag, events := range tags {
+	enabled := wc.streamEnabled(is)
+	for _, tag := range changed {
+		if !enabled || !wc.tagEnabled(is, tag) {
+			continue
+		}
 		// Compare current digest for tag with new
+		events := is.Status.Tags[tag]
 		imgref := getFullRef(is, tag)
 		digest := events.Items[0].Image
 
-		if wc.isPullthrough(events.Items[0].DockerImageReference) {
+		if !wc.explodable(events.Items[0].DockerImageReference) {
 			ctxLogger.WithField("tag", imgref).Debug("Ignoring pullthrough.")
 			continue
 		}
@@ -101,232 +171,388 @@ func (wc *watchClient) ImageUpdated(is *imageapi.ImageStream) {
 		curdigest := wc.digestForRef(imgref)
 
 		if digest != curdigest {
-			go wc.explode(imgref, digest)
+			trigger := tagTrigger(is, tag)
+			wc.startExplode(explodes, imgref, digest, trigger)
 			ctxLogger.WithFields(log.Fields{
-				"tag": tag,
+				"tag":     tag,
+				"trigger": trigger,
 			}).Info("Updated tag")
 		}
+		wc.queueHistorySync(imgref, events)
 	}
+
+	wc.removeTags(old, removed, ctxLogger)
+	return explodes
 }
 
-// Handle a DELETED image
+// Remove the refs of tags of a stream, and then the digests they pointed
+// to once no other ref does. Other streams, e.g. in projects the image was
+// tagged into, may still refer to them.
+func (wc *watchClient) removeTags(is *imageapi.ImageStream, tags []string, ctxLogger *log.Entry) {
+	var digests []string
+	for _, tag := range tags {
+		imgref := getFullRef(is, tag)
+		digests = append(digests, wc.recordedDigests(imgref)...)
+		if err := wc.removeRef(imgref); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"tag": tag,
+				"err": err,
+			}).Error("Failed to delete reference")
+			continue
+		}
+		ctxLogger.WithField("tag", tag).Info("Removed tag")
+	}
+	wc.removeUnreferencedDigests(digests, ctxLogger)
+}
+
+// Start an explode in the background, tracked by explodes
+func (wc *watchClient) startExplode(explodes *sync.WaitGroup, imgref, digest, trigger string) {
+	explodes.Add(1)
+	go func() {
+		defer explodes.Done()
+		wc.explode(imgref, digest, trigger)
+	}()
+}
+
+// Handle a DELETED image. Refs are removed based on what was recorded on
+// disk for the stream, as the deleted object may carry no tags at all, and
+// so are the digests they pointed to once no other ref does.
 func (wc *watchClient) ImageDeleted(is *imageapi.ImageStream) {
 	ctxLogger := log.WithFields(log.Fields{
 		"eventType": "DELETED",
-		"image":     is.Status.DockerImageRepository,
+		"stream":    path.Join(is.Namespace, is.Name),
 	})
 
-	tags := is.Status.Tags
-	if tags == nil {
-		ctxLogger.Error("No tags (???)")
+	tags := wc.recordedTags(is.Namespace, is.Name)
+	if len(tags) == 0 {
+		ctxLogger.Debug("Nothing recorded for stream")
 		return
 	}
 
-	//TODO: Process a Deleted image's tags for removal
-	for tag, events := range tags {
-		for _, event := range events.Items {
-			// TODO: locking, refcounting
-			basepath := path.Join(wc.OSTreeConfig.BasePath, "digest")
-			imgpath := path.Join(basepath, strings.Join(strings.SplitN(event.Image, ":", 2), "/"))
-			if err := os.RemoveAll(imgpath); err != nil {
-				ctxLogger.WithField("path", imgpath).Error("Failed to delete image")
-			}
-			dir := path.Dir(imgpath)
-			for dir != basepath {
-				os.Remove(dir)
-				dir = path.Dir(dir)
-			}
-		}
-		// TODO: locking
-		basepath := path.Join(wc.OSTreeConfig.BasePath, "images")
-		refpath := path.Join(basepath, getFullRef(is, tag))
-		if err := os.RemoveAll(refpath); err != nil {
-			ctxLogger.WithField("path", refpath).Error("Failed to delete reference")
+	wc.removeTags(is, tags, ctxLogger)
+}
+
+// Get the ImageStream a delete notification is about. Deletes missed while
+// the watch was down arrive as tombstones, which may hold a stale object or
+// only the stream's key.
+func deletedImageStream(obj interface{}) (*imageapi.ImageStream, error) {
+	switch obj := obj.(type) {
+	case *imageapi.ImageStream:
+		return obj, nil
+	case cache.DeletedFinalStateUnknown:
+		if is, ok := obj.Obj.(*imageapi.ImageStream); ok {
+			return is, nil
 		}
-		dir := path.Dir(refpath)
-		for dir != basepath {
-			os.Remove(dir)
-			dir = path.Dir(dir)
+		namespace, name, err := cache.SplitMetaNamespaceKey(obj.Key)
+		if err != nil {
+			return nil, err
 		}
+		return &imageapi.ImageStream{
+			ObjectMeta: kapi.ObjectMeta{Namespace: namespace, Name: name},
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected object of type %T", obj)
+}
+
+// Test that we have appropriate privilege for a given client and namespace.
+// Images are only listed when watching the whole cluster; otherwise they
+// are read through the ImageStreams (see getImage).
+func (wc *watchClient) checkAPIPerms(namespace string) error {
+	if _, err := wc.Client.ImageStreams(namespace).List(kapi.ListOptions{}); err != nil {
+		return err
 	}
+	if namespace != kapi.NamespaceAll {
+		return nil
+	}
+	_, err := wc.Client.Images().List(kapi.ListOptions{})
+	return err
 }
 
 // Test that we have appropriate privilege for a given client and namespace,
 // otherwise just die.
-func (wc *watchClient) assertAPIPerms() {
-	// TODO: this doesn't feel very Go
-	_, err1 := wc.Client.ImageStreams(wc.Namespace).List(kapi.ListOptions{})
-	_, err2 := wc.Client.Images().List(kapi.ListOptions{})
-	if err1 != nil || err2 != nil {
+func (wc *watchClient) assertAPIPerms(namespace string) {
+	if err := wc.checkAPIPerms(namespace); err != nil {
 		wc.Logger.WithFields(log.Fields{
-			"imagestreamerror": err1,
-			"imageserror":      err2,
+			"namespace": namespace,
+			"err":       err,
 		}).Fatal("Client does not have appropriate privileges")
 	}
 }
 
+// Watch the server for events of every enabled source
+func (wc *watchClient) Watch() {
+	if wc.Client == nil {
+		wc.Logger.Fatalf("Watching OpenShift requires %s", k8sServiceHostEnv)
+	}
+	if wc.ImageStreamSource {
+		wc.WatchImageStreams()
+	}
+	if wc.PodSource {
+		wc.WatchPods()
+	}
+	select {}
+}
+
 // Watch the server for ImageStream events
 func (wc *watchClient) WatchImageStreams() {
 
-	// Make sure we have permission to list ImageStreams in the current
-	// namespace and get images
-	wc.assertAPIPerms()
+	// A single cluster-wide informer is used when we may list ImageStreams
+	// at the cluster scope; otherwise the Projects we can see are tracked
+	// and one informer runs per namespace
+	if wc.clusterScopeAllowed() {
+		// Make sure we have permission to list ImageStreams and get images
+		wc.assertAPIPerms(kapi.NamespaceAll)
 
-	_, controller := framework.NewInformer(
-		&cache.ListWatch{
-			ListFunc: func(opts kapi.ListOptions) (runtime.Object, error) {
-				return wc.Client.ImageStreams(wc.Namespace).List(opts)
-			},
-			WatchFunc: func(opts kapi.ListOptions) (watch.Interface, error) {
-				return wc.Client.ImageStreams(wc.Namespace).Watch(opts)
-			},
-		},
+		// Images are looked up in the cache kept by this informer
+		wc.watchImages()
+
+		wc.watchNamespace(kapi.NamespaceAll, wait.NeverStop)
+		wc.Logger.Info("Watching ImageStreams...")
+	} else {
+		wc.watchNamespaces()
+	}
+}
+
+// Run an informer on the ImageStreams of a namespace (or of all of them)
+// until stop is closed, resuming from the last checkpoint if there is one.
+// Streams in namespaces which aren't watched are ignored.
+func (wc *watchClient) watchNamespace(namespace string, stop <-chan struct{}) {
+	rw := newResumingWatch(wc, namespace)
+	store, controller := framework.NewInformer(
+		rw.listWatch(),
 		&imageapi.ImageStream{},
 		10*time.Minute, // TODO: Understand the implications of different settings for this number.
 		framework.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
+				is := obj.(*imageapi.ImageStream)
+				if !wc.namespaceWatched(is.Namespace) {
+					return
+				}
 				wc.Logger.Debug("Image ADDED")
-				wc.ImageAdded(obj.(*imageapi.ImageStream))
+				rw.processed(is.ResourceVersion, wc.ImageAdded(is))
 			},
 			UpdateFunc: func(old, obj interface{}) {
+				is := obj.(*imageapi.ImageStream)
+				if !wc.namespaceWatched(is.Namespace) {
+					return
+				}
 				wc.Logger.Debug("Image UPDATED")
-				wc.ImageUpdated(obj.(*imageapi.ImageStream))
+				rw.processed(is.ResourceVersion, wc.ImageUpdated(old.(*imageapi.ImageStream), is))
 			},
 			DeleteFunc: func(obj interface{}) {
+				is, err := deletedImageStream(obj)
+				if err != nil {
+					wc.Logger.WithField("err", err).Error("Could not handle delete")
+					return
+				}
+				if !wc.namespaceWatched(is.Namespace) {
+					return
+				}
 				wc.Logger.Debug("Image DELETED")
-				wc.ImageDeleted(obj.(*imageapi.ImageStream))
+				wc.ImageDeleted(is)
+				rw.processed(is.ResourceVersion, nil)
 			},
 		})
 
-	wc.Logger.Info("Watching ImageStreams...")
-	go controller.Run(wait.NeverStop)
-	select {}
+	rw.cached = store.List
+
+	go controller.Run(stop)
 }
 
-// Get the root path of the blob store. This should make the blobs available if they are not already
-// e.g. if using a registry or FTP, etc. For now, only the file:// (local storage) scheme is supported
+// Get the root path of the blob store, for the file:// (local storage)
+// scheme, which indicates that the registry's storage is mounted locally.
+// Remote registries are read through openBlob.
 func (wc *watchClient) getBlobPath() string {
-	switch wc.BlobSource.Scheme {
-	case "file": // Indicates that the registry's storage is mounted locally
-		return path.Join(wc.BlobSource.Path, "docker/registry/v2/blobs/")
-	default: // Perhaps remote docker registry sources must be supported, maybe FTP, etc.
-		log.WithField("scheme", wc.BlobSource.Scheme).Fatal("BlobSource scheme not implemented.")
-	}
-	return ""
+	return path.Join(wc.BlobSource.Path, "docker/registry/v2/blobs/")
 }
 
 // Given a branch and digest, explode that digest into the branch
 // and check it out in a predictable way. Finally, update the tag
-// reference
-func (wc *watchClient) explode(imgref, digest string) {
-	// TODO: Lock this branch ref while we are editing it
-	repo := wc.OSTreeConfig.FullPath
-	checkoutpath := path.Join(wc.OSTreeConfig.BasePath, "digest", strings.Join(strings.Split(digest, ":"), "/"), "rootfs")
+// reference, recording what triggered the explode, and remove the digest
+// it pointed to before unless another ref still does. Failures are logged
+// here; the returned error is only for callers which wait for the result.
+func (wc *watchClient) explode(imgref, digest, trigger string) error {
+	ctxLogger := log.WithFields(log.Fields{
+		"ref":     imgref,
+		"digest":  digest,
+		"trigger": trigger,
+	})
+
+	link := path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link")
+	if err := wc.explodeForLink(path.Dir(imgref), digest, link); err != nil {
+		return err
+	}
+
+	// Update the ref
+	old := readLink(link)
+	if err := wc.updateRef(imgref, digest); err != nil {
+		ctxLogger.WithField("err", err).Error("Could not update reference")
+		return err
+	}
+	md := &refMetadata{Digest: digest, Trigger: trigger, Updated: time.Now().UTC()}
+	if err := wc.writeRefMetadata(imgref, md); err != nil {
+		ctxLogger.WithField("err", err).Warn("Could not write reference metadata")
+	}
+	ctxLogger.Info("Exploded")
+
+	if old != "" && old != digest {
+		wc.removeUnreferencedDigests([]string{old}, ctxLogger)
+	}
+	return nil
+}
+
+// Explode a digest which a link file is about to point to. The link is
+// indexed before the explode starts, so that the digest isn't removed as
+// unreferenced between the end of its explode and the link being written;
+// the index entry is dropped again if the explode fails.
+func (wc *watchClient) explodeForLink(repository, digest, lpath string) error {
+	wc.indexRef(digest, lpath)
+	err := wc.explodeDigest(repository, digest)
+	if err != nil && readLink(lpath) != digest {
+		wc.unindexRef(digest, lpath)
+	}
+	return err
+}
+
+// Explode a digest of the given repository (<namespace>/<name>) into
+// digest/<alg>/<hex>, unless it is there already. Failures are logged
+// here; the returned error only tells the caller to stop.
+func (wc *watchClient) explodeDigest(repository, digest string) error {
+	// Only one explode of a digest may run at once
+	unlock := wc.lockDigest(digest)
+	defer unlock()
+
+	checkoutpath := path.Join(wc.digestPath(digest), "rootfs")
 
 	ctxLogger := log.WithFields(log.Fields{
-		"ref":    imgref,
-		"digest": digest,
+		"repository": repository,
+		"digest":     digest,
 	})
 
 	// Check if the image exists already on the disk
 	// This could lead to collisions, but that risk is already
 	// existent and inherent in docker
-	if _, err := os.Open(checkoutpath); err == nil { // File exists
-		ctxLogger.Warn("Image already exists.")
-		if err := wc.updateRef(imgref, digest); err != nil {
-			ctxLogger.WithField("err", err).Error("Could not update reference")
-		}
-		return
+	if _, err := os.Stat(checkoutpath); err == nil { // File exists
+		ctxLogger.Debug("Image already exists.")
+		return nil
 	}
 
-	img, err := wc.Client.Images().Get(digest)
+	// Layer commits must survive until they are checked out
+	wc.gcLock.RLock()
+	defer wc.gcLock.RUnlock()
+
+	layerDigests, err := wc.imageLayers(repository, digest)
 	if err != nil {
-		ctxLogger.Errorf("Could not get image")
-		return
+		ctxLogger.WithField("err", err).Errorf("Could not get image")
+		return errImagePoisoned
 	}
 
-	blobstore := wc.getBlobPath()
 	branch := "oci/" + strings.Join(strings.SplitN(digest, ":", 2), "/")
 	os.MkdirAll(path.Dir(checkoutpath), 0755)
 
 	//lastCommit := "none"
 
-	layers := img.DockerImageLayers
-	for _, layer := range layers {
-		blob := layer.Name
-		comp := strings.SplitN(blob, ":", 2)
-		// TODO: ugh
-		blobpath := strings.Join(comp, "/"+comp[1][:2]+"/")
-		blobpath = path.Join(blobstore, blobpath, "data")
+	// Start from the longest layer prefix already exploded for another
+	// image, if any, and only apply the layers on top of it
+	chain := chainIDs(layerDigests)
+	reused, base := wc.longestStoredPrefix(chain)
+	if reused > 0 {
+		if err := wc.checkoutLayer(base, checkoutpath); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"commit": base,
+				"path":   checkoutpath,
+				"err":    err,
+			}).Error("Could not checkout shared layers (IMAGE POISONED)")
+			return errImagePoisoned
+		}
+		ctxLogger.WithField("layers", reused).Info("Reusing shared layers")
+	}
 
-		commit, err := wc.tarTreeCommit(blobpath, branch)
-		if err != nil {
-			// Fallback commit option
-			ctxLogger.WithField("err", err).Warn("Failed tar tree commit.")
-			commit, err = wc.explodeCommit(blobpath, branch)
-			if err != nil {
-				ctxLogger.WithFields(log.Fields{
-					"err":  err,
-					"blob": blob,
-				}).Error("Could not commit layer (IMAGE POISONED).")
-				return
-			}
+	// Layers are committed in parallel, but must be checked out in order
+	results := wc.commitLayers(repository, layerDigests[reused:], branch)
+	for i, lc := range results {
+		n := reused + i
+		if lc.err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"err":  lc.err,
+				"blob": layerDigests[n],
+			}).Error("Could not commit layer (IMAGE POISONED).")
+			return errImagePoisoned
 		}
+		commit := lc.commit
 
 		//lastCommit = commit
 
-		checkoutOpts := ostree.NewCheckoutOptions()
-		checkoutOpts.Union = true
-		checkoutOpts.Whiteouts = true
-		if err := ostree.Checkout(repo, checkoutpath, commit, checkoutOpts); err != nil {
+		if err := wc.checkoutLayer(commit, checkoutpath); err != nil {
 			ctxLogger.WithFields(log.Fields{
 				"commit": commit,
 				"path":   checkoutpath,
 				"err":    err,
 			}).Error("Could not checkout layer (IMAGE POISONED)")
-			return
+			return errImagePoisoned
+		}
+
+		// Most pushes only replace the top layer, so keep the state below
+		// it, as well as the whole image, for the next explode to start from
+		if n >= len(layerDigests)-2 {
+			if _, err := wc.commitPrefix(checkoutpath, chain[n]); err != nil {
+				ctxLogger.WithFields(log.Fields{
+					"chain": chain[n],
+					"err":   err,
+				}).Warn("Could not store layer prefix")
+			}
 		}
 	}
 
-	// Update the ref
-	if err := wc.updateRef(imgref, digest); err != nil {
-		ctxLogger.WithField("err", err).Error("Could not update reference")
-		return
+	md := &imageMetadata{Digest: digest, Layers: layerDigests}
+	if wc.SELinuxContext != "" {
+		md.SELinuxLabel = selinuxLabelFor(wc.SELinuxContext, digest)
+		if err := relabel(checkoutpath, md.SELinuxLabel); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"label": md.SELinuxLabel,
+				"err":   err,
+			}).Error("Could not label rootfs (IMAGE POISONED)")
+			return errImagePoisoned
+		}
 	}
-	ctxLogger.Info("Exploded")
+	if err := wc.writeRuntimeConfig(repository, digest); err != nil {
+		ctxLogger.WithField("err", err).Warn("Could not write runtime config")
+	}
+	if err := wc.writeImageMetadata(md); err != nil {
+		ctxLogger.WithField("err", err).Error("Could not write image metadata")
+	}
+	return nil
+}
+
+// Check a layer commit out on top of a rootfs. The checkout is not in user
+// mode, so ownership and xattrs (e.g. file capabilities) are written to disk.
+func (wc *watchClient) checkoutLayer(commit, checkoutpath string) error {
+	checkoutOpts := ostree.NewCheckoutOptions()
+	checkoutOpts.Union = true
+	checkoutOpts.Whiteouts = true
+	checkoutOpts.UserMode = false
+	wc.ostreeLock.Lock()
+	defer wc.ostreeLock.Unlock()
+	return ostree.Checkout(wc.OSTreeConfig.FullPath, checkoutpath, commit, checkoutOpts)
 }
 
-// Commit using OSTree's libarchive-based tar tree option
-func (wc *watchClient) tarTreeCommit(tarfile, branch string) (string, error) {
+// Commit using OSTree's libarchive-based tar tree option, with a directory
+// overlaid onto the tar's tree if given
+func (wc *watchClient) tarTreeCommit(tarfile, overlay, branch string) (string, error) {
 	commitCfg := ostree.NewCommitOptions()
 	commitCfg.Tree = []string{"tar=" + tarfile}
+	if overlay != "" {
+		commitCfg.Tree = append(commitCfg.Tree, "dir="+overlay)
+	}
 	commitCfg.TarAutoCreateParents = true
+	commitCfg.NoXattrs = false
 	//commitCfg.Parent = lastCommit TODO: golang bindings for this option result in runtime error
 	commitCfg.Fsync = false
+	wc.ostreeLock.Lock()
+	defer wc.ostreeLock.Unlock()
 	commit, err := ostree.Commit(wc.OSTreeConfig.FullPath, "", branch, commitCfg)
 	if err != nil {
 		return "", err
 	}
 	return commit, nil
 }
-
-// Commit from the filesystem using dockertar to unpack the archive (fallback)
-func (wc *watchClient) explodeCommit(tarfile, branch string) (string, error) {
-	tmp, err := ioutil.TempDir("", "")
-	if err != nil {
-		return "", err
-	}
-	defer os.RemoveAll(tmp)
-
-	if err := dtar.UntarPath(tarfile, tmp); err != nil {
-		return "", err
-	}
-
-	commitCfg := ostree.NewCommitOptions()
-	commitCfg.Fsync = false
-	commit, err := ostree.Commit(wc.OSTreeConfig.FullPath, tmp, branch, commitCfg)
-	if err != nil {
-		return "", err
-	}
-	return commit, nil
-}
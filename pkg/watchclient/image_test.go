@@ -0,0 +1,136 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+)
+
+// Build an ImageStream whose tags point at the given images
+func streamWithTags(tags map[string]string) *imageapi.ImageStream {
+	is := &imageapi.ImageStream{}
+	is.Status.Tags = map[string]imageapi.TagEventList{}
+	for tag, image := range tags {
+		is.Status.Tags[tag] = imageapi.TagEventList{
+			Items: []imageapi.TagEvent{{Image: image}},
+		}
+	}
+	return is
+}
+
+func TestDiffTags(t *testing.T) {
+	old := streamWithTags(map[string]string{
+		"latest": "sha256:aaaa",
+		"stable": "sha256:bbbb",
+		"old":    "sha256:cccc",
+	})
+	is := streamWithTags(map[string]string{
+		"latest": "sha256:dddd",
+		"stable": "sha256:bbbb",
+		"new":    "sha256:eeee",
+	})
+
+	changed, removed := diffTags(old, is)
+	sort.Strings(changed)
+
+	if len(changed) != 2 || changed[0] != "latest" || changed[1] != "new" {
+		t.Errorf("Expected latest and new to change, got %v", changed)
+	}
+	if len(removed) != 1 || removed[0] != "old" {
+		t.Errorf("Expected old to be removed, got %v", removed)
+	}
+}
+
+func TestDiffTagsUnchanged(t *testing.T) {
+	old := streamWithTags(map[string]string{"latest": "sha256:aaaa"})
+	is := streamWithTags(map[string]string{"latest": "sha256:aaaa"})
+
+	changed, removed := diffTags(old, is)
+	if len(changed) != 0 || len(removed) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", changed, removed)
+	}
+}
+
+func TestDiffTagsFromNoTags(t *testing.T) {
+	old := &imageapi.ImageStream{}
+	is := streamWithTags(map[string]string{"latest": "sha256:aaaa"})
+
+	changed, removed := diffTags(old, is)
+	if len(changed) != 1 || len(removed) != 0 {
+		t.Errorf("Expected one new tag, got %v and %v", changed, removed)
+	}
+}
+
+func TestDeletedImageStreamTombstone(t *testing.T) {
+	is, err := deletedImageStream(cache.DeletedFinalStateUnknown{Key: "myproject/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is.Namespace != "myproject" || is.Name != "app" {
+		t.Errorf("Expected myproject/app, got %s/%s", is.Namespace, is.Name)
+	}
+}
+
+func TestImageDeletedWithoutTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+		HistoryDepth: 2,
+	}
+	current := "sha256:aaaa"
+	previous := "sha256:bbbb"
+	for _, digest := range []string{current, previous} {
+		if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wc.updateRef("myproject/app/latest", current); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLink(path.Join(wc.historyPath("myproject/app/latest"), "1"), previous); err != nil {
+		t.Fatal(err)
+	}
+
+	wc.ImageDeleted(&imageapi.ImageStream{ObjectMeta: kapi.ObjectMeta{Namespace: "myproject", Name: "app"}})
+
+	for _, p := range []string{"images", "digest"} {
+		if entries, _ := ioutil.ReadDir(path.Join(dir, p)); len(entries) != 0 {
+			t.Errorf("Expected %s to be emptied, found %d entries", p, len(entries))
+		}
+	}
+}
+
+func TestImageAddedRemovesStaleTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "add-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	if err := wc.updateRef("myproject/app/old", "sha256:aaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag was deleted while the watch was down, and the informer's
+	// store is empty after resuming
+	wc.ImageAdded(&imageapi.ImageStream{ObjectMeta: kapi.ObjectMeta{Namespace: "myproject", Name: "app"}})
+
+	if tags := wc.recordedTags("myproject", "app"); len(tags) != 0 {
+		t.Errorf("Expected the stale tag to be removed, found %v", tags)
+	}
+}
@@ -0,0 +1,132 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// Watch the server for cluster-scoped Image events, keeping a local cache
+// of Images for explode and cleaning up after Images which get pruned
+func (wc *watchClient) watchImages() {
+	store, controller := framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts kapi.ListOptions) (runtime.Object, error) {
+				return wc.Client.Images().List(opts)
+			},
+			WatchFunc: func(opts kapi.ListOptions) (watch.Interface, error) {
+				return wc.Client.Images().Watch(opts)
+			},
+		},
+		&imageapi.Image{},
+		10*time.Minute,
+		framework.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj interface{}) {
+				switch obj := obj.(type) {
+				case *imageapi.Image:
+					wc.ImagePruned(obj.Name)
+				case cache.DeletedFinalStateUnknown:
+					// Images are cluster-scoped, so the key is the digest
+					wc.ImagePruned(obj.Key)
+				}
+			},
+		})
+	wc.imageStore = store
+
+	wc.Logger.Info("Watching Images...")
+	go controller.Run(wait.NeverStop)
+}
+
+// Get an Image of a repository (<namespace>/<name>) by digest, from the
+// local cache if it has been seen there, otherwise from the server. Without
+// the cluster-wide Image informer, we may not have access to Images at all,
+// so the Image is read through the ImageStream of the repository instead.
+func (wc *watchClient) getImage(repository, digest string) (*imageapi.Image, error) {
+	if wc.imageStore == nil {
+		isi, err := wc.Client.ImageStreamImages(path.Dir(repository)).Get(path.Base(repository), digest)
+		if err != nil {
+			return nil, err
+		}
+		return &isi.Image, nil
+	}
+
+	obj, exists, err := wc.imageStore.GetByKey(digest)
+	if err == nil && exists {
+		return obj.(*imageapi.Image), nil
+	}
+	log.WithField("digest", digest).Debug("Image not cached")
+	return wc.Client.Images().Get(digest)
+}
+
+// Get the layer digests of an image, bottom layer first. Images of archives
+// being exploded are looked up there. Without the Kubernetes API (in
+// listener mode), or for images of other registries, they are read from
+// the image's manifest.
+func (wc *watchClient) imageLayers(repository, digest string) ([]string, error) {
+	if layers, ok := wc.archiveLayers(digest); ok {
+		return layers, nil
+	}
+	if wc.Client == nil || hasRegistryHost(repository) {
+		return wc.manifestLayers(repository, digest)
+	}
+
+	img, err := wc.getImage(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]string, len(img.DockerImageLayers))
+	for i, layer := range img.DockerImageLayers {
+		layers[i] = layer.Name
+	}
+	return layers, nil
+}
+
+// Handle a deleted Image, e.g. one removed by `oadm prune images`. Its
+// exploded tree is removed unless a ref still points to it.
+func (wc *watchClient) ImagePruned(digest string) {
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType": "DELETED",
+		"digest":    digest,
+	})
+
+	if _, err := os.Stat(wc.digestPath(digest)); err != nil {
+		return
+	}
+	refs, err := wc.removeUnreferencedDigest(digest)
+	if err != nil {
+		ctxLogger.WithField("err", err).Error("Failed to delete image")
+		return
+	} else if len(refs) > 0 {
+		ctxLogger.WithField("refs", refs).Debug("Pruned image still referenced, keeping it")
+		return
+	}
+	ctxLogger.Info("Removed pruned image")
+}
@@ -0,0 +1,301 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	dtar "github.com/docker/docker/pkg/archive"
+
+	ostree "github.com/14rcole/ostree-go/pkg/otbuiltin"
+)
+
+const defaultLayerConcurrency = 4
+
+// The length of the end-of-archive marker of a tar stream: two zero blocks
+const tarEndLen = 2 * 512
+
+// The outcome of committing a single layer
+type layerCommit struct {
+	commit string
+	err    error
+}
+
+// Commit the layers of an image in parallel, with at most LayerConcurrency
+// layers in flight, returning their outcomes in layer order. Each worker
+// takes every LayerConcurrency-th layer, so that the bottom layers start
+// first.
+func (wc *watchClient) commitLayers(repository string, blobs []string, branch string) []layerCommit {
+	concurrency := wc.LayerConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]layerCommit, len(blobs))
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(blobs); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(blobs); i += concurrency {
+				results[i].commit, results[i].err = wc.commitLayer(repository, blobs[i], branch)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return results
+}
+
+// A layer decompressed onto the explode volume
+type spooledLayer struct {
+	// The uncompressed tar
+	tarfile string
+	// The entries of the layer carrying xattrs, recreated with them, if
+	// there are any
+	xattrdir string
+	xattrs   layerXattrs
+}
+
+// Remove a spooled layer
+func (l *spooledLayer) remove() {
+	os.Remove(l.tarfile)
+	if l.xattrdir != "" {
+		os.RemoveAll(l.xattrdir)
+	}
+}
+
+// Commit a layer blob into the given branch. Layers are streamed through
+// OSTree's libarchive-based tar import, or decompressed onto the explode
+// volume first if SpoolLayers is set, with the entries carrying xattrs
+// overlaid either way so that the xattrs are kept. Unpacking the layer is
+// the last resort for layers libarchive fails on, if enabled.
+func (wc *watchClient) commitLayer(repository, blob, branch string) (string, error) {
+	var layer *spooledLayer
+	var commit string
+	var err error
+	if wc.SpoolLayers {
+		layer, err = wc.spoolLayer(repository, blob)
+		if err != nil {
+			return "", err
+		}
+		defer layer.remove()
+		commit, err = wc.tarTreeCommit(layer.tarfile, layer.xattrdir, branch)
+	} else {
+		commit, err = wc.streamCommit(repository, blob, branch)
+	}
+	if err == nil || !wc.UnpackFallback {
+		return commit, err
+	}
+
+	// Fallback commit option
+	log.WithFields(log.Fields{
+		"err":  err,
+		"blob": blob,
+	}).Warn("Failed tar import.")
+	if layer == nil {
+		// The stream is gone, so the blob is read again
+		if layer, err = wc.spoolLayer(repository, blob); err != nil {
+			return "", err
+		}
+		defer layer.remove()
+	}
+	return wc.unpackCommit(layer, branch)
+}
+
+// Commit a layer by streaming it through a pipe into OSTree's libarchive
+// based tar import: blob, decompressor and tar reader all run in bounded
+// memory, and nothing is written to disk but the OSTree objects and the
+// few entries carrying xattrs, which are extracted on the way and overlaid
+// onto the import. The import reads the pipe while holding ostreeLock, so
+// the layer is decompressed alongside, but not in parallel with the
+// imports of other layers.
+func (wc *watchClient) streamCommit(repository, blob, branch string) (string, error) {
+	src, err := wc.openBlob(repository, blob)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	stream, err := dtar.DecompressStream(src)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	xattrdir, err := ioutil.TempDir(wc.OSTreeConfig.BasePath, ".xattrs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(xattrdir)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	fed := make(chan error, 1)
+	go func() {
+		fed <- feedLayer(stream, w, xattrdir)
+	}()
+
+	// libarchive reopens the read end of the pipe through /proc
+	commit, err := wc.tarTreeCommit(fmt.Sprintf("/proc/self/fd/%d", r.Fd()), xattrdir, branch)
+
+	// Should OSTree have given up without draining the pipe, this makes the
+	// feeder fail with EPIPE instead of blocking
+	r.Close()
+
+	if ferr := <-fed; err == nil {
+		// A truncated stream can look like a complete archive to libarchive
+		err = ferr
+	}
+	if err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// Copy an uncompressed layer into a pipe, extracting the entries carrying
+// xattrs under dir on the way. The end-of-archive marker is held back until
+// they are all extracted, as OSTree reads the overlay as soon as the tar
+// import is over.
+func feedLayer(stream io.Reader, w io.WriteCloser, dir string) error {
+	defer w.Close()
+
+	held := &holdbackWriter{w: w, n: tarEndLen}
+	if _, err := extractXattrEntries(io.TeeReader(stream, held), dir); err != nil {
+		return err
+	}
+	if err := held.flush(); err != nil {
+		return err
+	}
+	// Pass on the end-of-archive padding the tar reader didn't consume.
+	// libarchive may have stopped reading already, which is fine.
+	io.Copy(w, stream)
+	return nil
+}
+
+// A writer passing on all but the last n bytes written to it, until flushed
+type holdbackWriter struct {
+	w   io.Writer
+	n   int
+	buf []byte
+}
+
+func (h *holdbackWriter) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+	if over := len(h.buf) - h.n; over > 0 {
+		if _, err := h.w.Write(h.buf[:over]); err != nil {
+			return 0, err
+		}
+		h.buf = append(h.buf[:0], h.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// Pass on the bytes held back
+func (h *holdbackWriter) flush() error {
+	_, err := h.w.Write(h.buf)
+	h.buf = nil
+	return err
+}
+
+// Decompress a layer blob into a temporary tar file on the explode volume,
+// extracting the entries carrying xattrs on the way. The blob is streamed
+// from the blob source and memory use is bounded. This runs outside
+// ostreeLock, so that layers decompress in parallel and only their imports
+// are serialized, at the cost of a full uncompressed copy of each layer in
+// flight. The caller removes the spooled layer.
+func (wc *watchClient) spoolLayer(repository, blob string) (*spooledLayer, error) {
+	src, err := wc.openBlob(repository, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	stream, err := dtar.DecompressStream(src)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	tmp, err := ioutil.TempFile(wc.OSTreeConfig.BasePath, ".layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	layer := &spooledLayer{tarfile: tmp.Name()}
+
+	layer.xattrdir, err = ioutil.TempDir(wc.OSTreeConfig.BasePath, ".xattrs-")
+	if err != nil {
+		layer.remove()
+		return nil, err
+	}
+
+	tee := io.TeeReader(stream, tmp)
+	layer.xattrs, err = extractXattrEntries(tee, layer.xattrdir)
+	if err == nil {
+		// Keep the end-of-archive padding the tar reader didn't consume
+		_, err = io.Copy(ioutil.Discard, tee)
+	}
+	if err != nil {
+		layer.remove()
+		return nil, err
+	}
+	if len(layer.xattrs) == 0 {
+		os.RemoveAll(layer.xattrdir)
+		layer.xattrdir = ""
+	}
+	return layer, nil
+}
+
+// Commit a spooled layer from the filesystem, using dockertar to unpack it
+// onto the explode volume rather than into $TMPDIR, and applying its xattrs
+func (wc *watchClient) unpackCommit(layer *spooledLayer, branch string) (string, error) {
+	tarfile, err := os.Open(layer.tarfile)
+	if err != nil {
+		return "", err
+	}
+	defer tarfile.Close()
+
+	tmp, err := ioutil.TempDir(wc.OSTreeConfig.BasePath, ".unpack-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := dtar.UntarUncompressed(tarfile, tmp, nil); err != nil {
+		return "", err
+	}
+	if err := layer.xattrs.apply(tmp); err != nil {
+		return "", err
+	}
+
+	commitCfg := ostree.NewCommitOptions()
+	commitCfg.NoXattrs = false
+	commitCfg.Fsync = false
+	wc.ostreeLock.Lock()
+	defer wc.ostreeLock.Unlock()
+	return ostree.Commit(wc.OSTreeConfig.FullPath, tmp, branch, commitCfg)
+}
@@ -0,0 +1,119 @@
+package watchclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+func TestSpoolLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+		BlobSource:   &url.URL{Scheme: "file", Path: dir},
+	}
+	layers := map[string][]byte{
+		"plain": buildLayer(t, []testEntry{
+			{&tar.Header{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir}, ""},
+			{&tar.Header{Name: "etc/motd", Mode: 0644, Typeflag: tar.TypeReg}, "hello"},
+		}),
+		"xattrs": xattrLayer(t),
+	}
+	if os.Geteuid() != 0 {
+		// Recreating entries with xattrs requires root
+		delete(layers, "xattrs")
+	}
+	for name, layer := range layers {
+		spooled, err := wc.spoolLayer("test/spool", writeBlob(t, dir, layer))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		out, err := ioutil.ReadFile(spooled.tarfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spooled.remove()
+		if !bytes.Equal(out, layer) {
+			t.Errorf("%s: layer was altered: %d bytes in, %d out", name, len(layer), len(out))
+		}
+		if (name == "xattrs") != (len(spooled.xattrs) > 0 && spooled.xattrdir != "") {
+			t.Errorf("%s: unexpected xattrs %v", name, spooled.xattrs)
+		}
+	}
+}
+
+func TestHoldbackWriter(t *testing.T) {
+	var out bytes.Buffer
+	held := &holdbackWriter{w: &out, n: 4}
+	for _, chunk := range []string{"ab", "cdef", "g", "hi"} {
+		if _, err := held.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "abcde" {
+		t.Errorf("Expected the last 4 bytes to be held back, got %q", out.String())
+	}
+	if err := held.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "abcdefghi" {
+		t.Errorf("Expected every byte after a flush, got %q", out.String())
+	}
+}
+
+func TestFeedLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Recreating entries with xattrs requires root")
+	}
+	dir, err := ioutil.TempDir("", "feed-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := xattrLayer(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fed := make(chan error, 1)
+	go func() {
+		fed <- feedLayer(bytes.NewReader(layer), w, dir)
+	}()
+
+	// The layer ends with its end-of-archive marker; once that comes
+	// through, the overlay must be complete
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(len(layer))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(dir, "usr/bin/ping")); err != nil {
+		t.Errorf("Expected ping to be extracted before the end of the archive: %v", err)
+	}
+	// The metadata of directories is set last
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the overlay's directories to be set up before the end of the archive: %v", err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-fed; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(out, rest...), layer) {
+		t.Errorf("Layer was altered: %d bytes in, %d out", len(layer), len(out)+len(rest))
+	}
+}
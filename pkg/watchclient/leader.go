@@ -0,0 +1,165 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+)
+
+// The annotation holding the leader record on the lock ConfigMap, as used
+// by Kubernetes' own leader election
+const leaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+const defaultLeaderLockName = "os-explode"
+
+// How long a leader holds the lock without renewing it, how long it keeps
+// trying to renew before giving up, and how often it tries
+const leaseDuration = 15 * time.Second
+const renewDeadline = 10 * time.Second
+const retryPeriod = 2 * time.Second
+
+// The leader record stored on the lock
+type leaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaderTransitions    int       `json:"leaderTransitions"`
+}
+
+// Run once we hold the leader lock, if leader election is enabled. Should
+// the lock be lost, the process exits so that nothing is written to disk
+// alongside the new leader.
+func (wc *watchClient) RunAsLeader(run func()) {
+	if wc.LeaderLockName == "" {
+		run()
+		return
+	}
+
+	ctxLogger := log.WithFields(log.Fields{
+		"lock":     wc.LeaderLockNamespace + "/" + wc.LeaderLockName,
+		"identity": wc.Identity,
+	})
+	ctxLogger.Info("Waiting for leadership...")
+	for !wc.tryAcquireOrRenew() {
+		time.Sleep(retryPeriod)
+	}
+	ctxLogger.Info("Became leader")
+
+	go func() {
+		renewed := time.Now()
+		for {
+			time.Sleep(retryPeriod)
+			if wc.tryAcquireOrRenew() {
+				renewed = time.Now()
+			} else if time.Since(renewed) > renewDeadline {
+				ctxLogger.Fatal("Lost leadership")
+			}
+		}
+	}()
+
+	run()
+}
+
+// Try to acquire the leader lock, or renew it if we hold it already. The
+// lock is taken over once its holder hasn't renewed it for leaseDuration,
+// as measured on our own clock since we last saw the record change.
+func (wc *watchClient) tryAcquireOrRenew() bool {
+	ctxLogger := log.WithField("lock", wc.LeaderLockNamespace+"/"+wc.LeaderLockName)
+	configmaps := wc.KubeClient.ConfigMaps(wc.LeaderLockNamespace)
+
+	now := time.Now()
+	record := leaderRecord{
+		HolderIdentity:       wc.Identity,
+		LeaseDurationSeconds: int(leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm, err := configmaps.Get(wc.LeaderLockName)
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			ctxLogger.WithField("err", err).Error("Could not get leader lock")
+			return false
+		}
+		raw, _ := json.Marshal(record)
+		_, err := configmaps.Create(&kapi.ConfigMap{
+			ObjectMeta: kapi.ObjectMeta{
+				Namespace:   wc.LeaderLockNamespace,
+				Name:        wc.LeaderLockName,
+				Annotations: map[string]string{leaderAnnotation: string(raw)},
+			},
+		})
+		if err != nil {
+			ctxLogger.WithField("err", err).Debug("Could not create leader lock")
+			return false
+		}
+		wc.observeLeader(string(raw), now)
+		return true
+	}
+
+	var current leaderRecord
+	raw := cm.Annotations[leaderAnnotation]
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &current); err != nil {
+			ctxLogger.WithField("err", err).Error("Could not parse leader record")
+			return false
+		}
+	}
+	if raw != wc.leaderObserved {
+		wc.observeLeader(raw, now)
+	}
+
+	if current.HolderIdentity != "" && current.HolderIdentity != wc.Identity &&
+		wc.leaderObservedTime.Add(leaseDuration).After(now) {
+		return false
+	}
+
+	if current.HolderIdentity == wc.Identity {
+		record.AcquireTime = current.AcquireTime
+		record.LeaderTransitions = current.LeaderTransitions
+	} else {
+		record.LeaderTransitions = current.LeaderTransitions + 1
+	}
+
+	// The update fails on a conflict should another replica have written
+	// the lock since we read it
+	newraw, _ := json.Marshal(record)
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[leaderAnnotation] = string(newraw)
+	if _, err := configmaps.Update(cm); err != nil {
+		ctxLogger.WithField("err", err).Debug("Could not update leader lock")
+		return false
+	}
+	wc.observeLeader(string(newraw), now)
+	return true
+}
+
+// Remember the last leader record we saw, and when we saw it
+func (wc *watchClient) observeLeader(raw string, now time.Time) {
+	wc.leaderObserved = raw
+	wc.leaderObservedTime = now
+}
@@ -0,0 +1,62 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"sync"
+)
+
+// A lock on one digest, dropped once nobody holds or waits for it
+type digestLock struct {
+	sync.Mutex
+	users int
+}
+
+// Take the lock on a digest, returning the function which releases it
+func (wc *watchClient) lockDigest(digest string) func() {
+	wc.digestLocksMu.Lock()
+	if wc.digestLocks == nil {
+		wc.digestLocks = make(map[string]*digestLock)
+	}
+	l, ok := wc.digestLocks[digest]
+	if !ok {
+		l = &digestLock{}
+		wc.digestLocks[digest] = l
+	}
+	l.users++
+	wc.digestLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		wc.digestLocksMu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(wc.digestLocks, digest)
+		}
+		wc.digestLocksMu.Unlock()
+	}
+}
+
+// Determine whether a digest's lock is held or waited for
+func (wc *watchClient) digestBusy(digest string) bool {
+	wc.digestLocksMu.Lock()
+	defer wc.digestLocksMu.Unlock()
+	_, ok := wc.digestLocks[digest]
+	return ok
+}
@@ -0,0 +1,40 @@
+package watchclient
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLockDigestExcludes(t *testing.T) {
+	wc := &watchClient{}
+
+	var wg sync.WaitGroup
+	holders := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := wc.lockDigest("sha256:aaaa")
+			holders++
+			if holders != 1 {
+				t.Error("Digest lock held twice")
+			}
+			holders--
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(wc.digestLocks) != 0 {
+		t.Errorf("Expected no locks left, got %d", len(wc.digestLocks))
+	}
+}
+
+func TestLockDigestIndependent(t *testing.T) {
+	wc := &watchClient{}
+
+	unlockA := wc.lockDigest("sha256:aaaa")
+	unlockB := wc.lockDigest("sha256:bbbb")
+	unlockB()
+	unlockA()
+}
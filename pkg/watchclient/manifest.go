@@ -0,0 +1,129 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+const (
+	schema1MediaType       = "application/vnd.docker.distribution.manifest.v1+json"
+	schema1SignedMediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	schema2MediaType       = "application/vnd.docker.distribution.manifest.v2+json"
+	ociManifestMediaType   = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// The manifest types we can explode, in order of preference
+var manifestMediaTypes = []string{
+	schema2MediaType,
+	ociManifestMediaType,
+	schema1SignedMediaType,
+	schema1MediaType,
+}
+
+// The fields of schema1, schema2 and OCI manifests which list layers and
+// the image config
+type imageManifest struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Config        struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// Read the manifest of an image
+func (wc *watchClient) readManifest(repository, digest string) (*imageManifest, error) {
+	src, err := wc.openManifest(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	manifest := &imageManifest{}
+	if err := json.NewDecoder(src).Decode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Get the layer digests of an image from its manifest, bottom layer first
+func (wc *watchClient) manifestLayers(repository, digest string) ([]string, error) {
+	manifest, err := wc.readManifest(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.layers()
+}
+
+// Get the run config of an image from the config blob its manifest names,
+// or, for schema1, from the v1 image of its top layer
+func (wc *watchClient) manifestConfig(repository, digest string) (*imageapi.DockerConfig, error) {
+	manifest, err := wc.readManifest(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case manifest.SchemaVersion == 1 && len(manifest.History) > 0:
+		// schema1 lists the top layer first
+		return parseRunConfig([]byte(manifest.History[0].V1Compatibility))
+	case manifest.SchemaVersion == 2 && manifest.Config.Digest != "":
+		src, err := wc.openBlob(repository, manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		raw, err := ioutil.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		return parseRunConfig(raw)
+	}
+	return nil, fmt.Errorf("manifest names no image config")
+}
+
+// List the layers of a manifest, bottom layer first
+func (m *imageManifest) layers() ([]string, error) {
+	var layers []string
+	switch {
+	case m.SchemaVersion == 1:
+		// schema1 lists the top layer first
+		for i := len(m.FSLayers) - 1; i >= 0; i-- {
+			layers = append(layers, m.FSLayers[i].BlobSum)
+		}
+	case m.SchemaVersion == 2 && len(m.Layers) > 0:
+		for _, layer := range m.Layers {
+			layers = append(layers, layer.Digest)
+		}
+	default:
+		// e.g. a manifest list, which names no layers of its own
+		return nil, fmt.Errorf("manifest lists no layers")
+	}
+	return layers, nil
+}
@@ -0,0 +1,38 @@
+package watchclient
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestManifestLayers(t *testing.T) {
+	manifests := map[string]string{
+		"schema2": `{"schemaVersion": 2, "layers": [{"digest": "sha256:aaaa"}, {"digest": "sha256:bbbb"}]}`,
+		"schema1": `{"schemaVersion": 1, "fsLayers": [{"blobSum": "sha256:bbbb"}, {"blobSum": "sha256:aaaa"}]}`,
+	}
+	for name, raw := range manifests {
+		var manifest imageManifest
+		if err := json.Unmarshal([]byte(raw), &manifest); err != nil {
+			t.Fatal(err)
+		}
+		layers, err := manifest.layers()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(layers) != 2 || layers[0] != "sha256:aaaa" || layers[1] != "sha256:bbbb" {
+			t.Errorf("%s: expected the bottom layer first, got %v", name, layers)
+		}
+	}
+}
+
+func TestManifestListHasNoLayers(t *testing.T) {
+	var manifest imageManifest
+	raw := `{"schemaVersion": 2, "manifests": [{"digest": "sha256:aaaa"}]}`
+	if err := json.Unmarshal([]byte(raw), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifest.layers(); err == nil {
+		t.Error("Expected a manifest list to be refused")
+	}
+}
@@ -0,0 +1,87 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+const imageMetadataFile = "metadata.json"
+
+// Information recorded next to an exploded image's rootfs
+type imageMetadata struct {
+	Digest       string   `json:"digest"`
+	Layers       []string `json:"layers,omitempty"`
+	SELinuxLabel string   `json:"selinuxLabel,omitempty"`
+}
+
+// Write the metadata of an exploded image to digest/<alg>/<hex>/metadata.json
+func (wc *watchClient) writeImageMetadata(md *imageMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(wc.digestPath(md.Digest), imageMetadataFile), data, 0644)
+}
+
+// Read the metadata of an exploded image
+func (wc *watchClient) readImageMetadata(digest string) (*imageMetadata, error) {
+	data, err := ioutil.ReadFile(path.Join(wc.digestPath(digest), imageMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	md := &imageMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// Information recorded next to an image reference's link
+type refMetadata struct {
+	Digest string `json:"digest"`
+	// What moved the reference to the digest: push, import, scheduled-import
+	// or tag (see trigger.go), or the Docker daemon's event
+	Trigger string    `json:"trigger,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Write the metadata of an image reference to images/<ref>/metadata.json
+func (wc *watchClient) writeRefMetadata(imgref string, md *refMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, imageMetadataFile), data, 0644)
+}
+
+// Read the metadata of an image reference
+func (wc *watchClient) readRefMetadata(imgref string) (*refMetadata, error) {
+	data, err := ioutil.ReadFile(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, imageMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	md := &refMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
@@ -0,0 +1,188 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	projectapi "github.com/openshift/origin/pkg/project/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// Split a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Determine whether a name matches any of a list of globs
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether ImageStreams in a namespace are to be watched. With no
+// include patterns, every namespace not excluded is.
+func (wc *watchClient) namespaceWatched(namespace string) bool {
+	if len(wc.Namespaces) > 0 && !matchesAny(wc.Namespaces, namespace) {
+		return false
+	}
+	return !matchesAny(wc.ExcludeNamespaces, namespace)
+}
+
+// Determine whether we may list ImageStreams at the cluster scope
+func (wc *watchClient) clusterScopeAllowed() bool {
+	_, err := wc.Client.ImageStreams(kapi.NamespaceAll).List(kapi.ListOptions{})
+	if err != nil {
+		wc.Logger.WithField("err", err).Debug("Cluster scope not allowed")
+	}
+	return err == nil
+}
+
+// Split include patterns into the literal namespace names among them, and
+// whether any of them is a glob
+func literalNamespaces(patterns []string) (literals []string, globs bool) {
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[\\") {
+			globs = true
+		} else {
+			literals = append(literals, pattern)
+		}
+	}
+	return literals, globs
+}
+
+// Watch the namespaces in scope when we can't watch at the cluster scope.
+// Include patterns which aren't globs are watched as they are, since we may
+// have access to a namespace without seeing its Project; globs, or the lack
+// of include patterns, are matched against the Projects we can see.
+func (wc *watchClient) watchNamespaces() {
+	literals, globs := literalNamespaces(wc.Namespaces)
+	for _, namespace := range literals {
+		wc.startNamespace(namespace)
+	}
+
+	if globs || len(wc.Namespaces) == 0 {
+		wc.watchProjects()
+		wc.Logger.Info("Watching Projects...")
+		return
+	}
+
+	wc.namespaceWatchesMu.Lock()
+	defer wc.namespaceWatchesMu.Unlock()
+	if len(wc.namespaceWatches) == 0 {
+		wc.Logger.Fatal("No namespaces to watch")
+	}
+}
+
+// Track the Projects we can see, running an ImageStream informer for each
+// watched namespace while we have access to it
+func (wc *watchClient) watchProjects() {
+	_, controller := framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts kapi.ListOptions) (runtime.Object, error) {
+				return wc.Client.Projects().List(opts)
+			},
+			WatchFunc: func(opts kapi.ListOptions) (watch.Interface, error) {
+				return wc.Client.Projects().Watch(opts)
+			},
+		},
+		&projectapi.Project{},
+		10*time.Minute,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				wc.startNamespace(obj.(*projectapi.Project).Name)
+			},
+			UpdateFunc: func(old, obj interface{}) {
+				// Retries namespaces we lacked permissions for on resync
+				wc.startNamespace(obj.(*projectapi.Project).Name)
+			},
+			DeleteFunc: func(obj interface{}) {
+				switch obj := obj.(type) {
+				case *projectapi.Project:
+					wc.stopNamespace(obj.Name)
+				case cache.DeletedFinalStateUnknown:
+					// Projects are cluster-scoped, so the key is the name
+					wc.stopNamespace(obj.Key)
+				}
+			},
+		})
+
+	go controller.Run(wait.NeverStop)
+}
+
+// Start an ImageStream informer for a namespace, unless it isn't watched,
+// already has one, or we lack the permissions to run one
+func (wc *watchClient) startNamespace(namespace string) {
+	if !wc.namespaceWatched(namespace) {
+		return
+	}
+
+	wc.namespaceWatchesMu.Lock()
+	defer wc.namespaceWatchesMu.Unlock()
+
+	if wc.namespaceWatches == nil {
+		wc.namespaceWatches = make(map[string]chan struct{})
+	}
+	if _, ok := wc.namespaceWatches[namespace]; ok {
+		return
+	}
+
+	ctxLogger := log.WithField("namespace", namespace)
+	if err := wc.checkAPIPerms(namespace); err != nil {
+		ctxLogger.WithField("err", err).Warn("Client does not have appropriate privileges")
+		return
+	}
+
+	stop := make(chan struct{})
+	wc.namespaceWatches[namespace] = stop
+	wc.watchNamespace(namespace, stop)
+	ctxLogger.Info("Watching ImageStreams...")
+}
+
+// Stop the ImageStream informer of a namespace we lost access to. What was
+// exploded from it is left in place.
+func (wc *watchClient) stopNamespace(namespace string) {
+	wc.namespaceWatchesMu.Lock()
+	defer wc.namespaceWatchesMu.Unlock()
+
+	if stop, ok := wc.namespaceWatches[namespace]; ok {
+		close(stop)
+		delete(wc.namespaceWatches, namespace)
+		log.WithField("namespace", namespace).Info("Stopped watching ImageStreams")
+	}
+}
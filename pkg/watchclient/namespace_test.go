@@ -0,0 +1,47 @@
+package watchclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceWatched(t *testing.T) {
+	wc := &watchClient{
+		Namespaces:        splitList("team-*, shared"),
+		ExcludeNamespaces: splitList("team-sandbox"),
+	}
+	for namespace, watched := range map[string]bool{
+		"team-a":       true,
+		"shared":       true,
+		"team-sandbox": false,
+		"openshift":    false,
+	} {
+		if wc.namespaceWatched(namespace) != watched {
+			t.Errorf("namespaceWatched(%q) should be %v", namespace, watched)
+		}
+	}
+}
+
+func TestNamespaceWatchedExcludeOnly(t *testing.T) {
+	wc := &watchClient{ExcludeNamespaces: splitList("openshift,openshift-*")}
+	if !wc.namespaceWatched("myproject") {
+		t.Error("Expected myproject to be watched")
+	}
+	if wc.namespaceWatched("openshift-infra") {
+		t.Error("Expected openshift-infra to be excluded")
+	}
+}
+
+func TestLiteralNamespaces(t *testing.T) {
+	literals, globs := literalNamespaces(splitList("shared,team-*,myproject"))
+	if !reflect.DeepEqual(literals, []string{"shared", "myproject"}) {
+		t.Errorf("Unexpected literals %v", literals)
+	}
+	if !globs {
+		t.Error("Expected team-* to be taken as a glob")
+	}
+
+	if _, globs := literalNamespaces(splitList("shared")); globs {
+		t.Error("Expected no globs")
+	}
+}
@@ -0,0 +1,222 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/reference"
+)
+
+// The path registries post notifications to
+const notifyPath = "/notifications"
+
+// The digests notifications and one-shot references may name. Anything
+// else could make paths built from them escape the explode volume.
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]{32,}$`)
+
+// A registry notification envelope, as sent to the registry's
+// notifications.endpoints
+type notificationEnvelope struct {
+	Events []notificationEvent `json:"events"`
+}
+
+// The fields of a registry notification event we act upon
+type notificationEvent struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Target struct {
+		MediaType  string `json:"mediaType"`
+		Digest     string `json:"digest"`
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+}
+
+// Listen for registry notifications, exploding pushed images and removing
+// deleted ones, without the Kubernetes API
+func (wc *watchClient) ServeNotifications() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(notifyPath, wc.handleNotifications)
+
+	wc.Logger.Info("Listening for registry notifications...")
+	wc.Logger.Fatal(http.ListenAndServe(wc.NotifyListen, mux))
+}
+
+// Handle a POSTed notification envelope. The registry retries envelopes
+// which aren't acknowledged, so events are acknowledged once dispatched
+// rather than once processed.
+func (wc *watchClient) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !wc.notifyAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var envelope notificationEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		log.WithField("err", err).Error("Could not decode notifications")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, event := range envelope.Events {
+		if err := validateNotification(event); err != nil {
+			log.WithFields(log.Fields{
+				"id":  event.ID,
+				"err": err,
+			}).Error("Rejecting notifications")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, event := range envelope.Events {
+		wc.notificationReceived(event)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Determine whether a notification carries the token, which is required
+// unless authentication was explicitly disabled
+func (wc *watchClient) notifyAuthorized(r *http.Request) bool {
+	if wc.NotifyInsecure {
+		return true
+	}
+	if wc.NotifyToken == "" {
+		return false
+	}
+	expected := []byte("Bearer " + wc.NotifyToken)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// Check the names a notification event carries before any of them is used
+// to build a path: the repository and tag must follow the distribution
+// reference grammar, and the digest must be <algorithm>:<hex>
+func validateNotification(event notificationEvent) error {
+	target := event.Target
+	if target.Repository == "" {
+		return fmt.Errorf("event %s has no repository", event.ID)
+	}
+	named, err := reference.WithName(target.Repository)
+	if err != nil {
+		return fmt.Errorf("invalid repository %q: %v", target.Repository, err)
+	}
+	if target.Tag != "" {
+		if _, err := reference.WithTag(named, target.Tag); err != nil {
+			return fmt.Errorf("invalid tag %q: %v", target.Tag, err)
+		}
+	}
+	if target.Digest == "" && target.Tag == "" {
+		return fmt.Errorf("event %s has neither a tag nor a digest", event.ID)
+	}
+	if target.Digest != "" && !digestRegexp.MatchString(target.Digest) {
+		return fmt.Errorf("invalid digest %q", target.Digest)
+	}
+	return nil
+}
+
+// Determine whether a media type is that of an image manifest
+func isManifest(mediatype string) bool {
+	for _, mt := range manifestMediaTypes {
+		if mediatype == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatch a registry event to the explode and delete pipeline
+func (wc *watchClient) notificationReceived(event notificationEvent) {
+	target := event.Target
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType":  event.Action,
+		"id":         event.ID,
+		"repository": target.Repository,
+		"tag":        target.Tag,
+		"digest":     target.Digest,
+	})
+
+	switch event.Action {
+	case "push":
+		// Layer pushes are notified too, but only manifests are exploded
+		if !isManifest(target.MediaType) {
+			return
+		}
+		if target.Tag == "" {
+			ctxLogger.Info("New image")
+			go wc.explodeDigest(target.Repository, target.Digest)
+			return
+		}
+		imgref := path.Join(target.Repository, target.Tag)
+		if target.Digest != wc.digestForRef(imgref) {
+			ctxLogger.Info("New tag")
+			go wc.explode(imgref, target.Digest, triggerPush)
+		}
+	case "delete":
+		go wc.manifestDeleted(target.Repository, target.Tag, target.Digest)
+	}
+}
+
+// Remove the refs of a repository a deleted manifest was tagged as, then
+// the manifest's exploded tree unless something else still points to it.
+// Deleting a tag only removes that ref.
+func (wc *watchClient) manifestDeleted(repository, tag, digest string) {
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType":  "delete",
+		"repository": repository,
+	})
+
+	var tags []string
+	if tag != "" {
+		tags = append(tags, tag)
+	} else {
+		entries, _ := ioutil.ReadDir(path.Join(wc.OSTreeConfig.BasePath, "images", repository))
+		for _, entry := range entries {
+			link := path.Join(wc.OSTreeConfig.BasePath, "images", repository, entry.Name(), "link")
+			if entry.IsDir() && readLink(link) == digest {
+				tags = append(tags, entry.Name())
+			}
+		}
+	}
+
+	for _, tag := range tags {
+		if err := wc.removeRef(path.Join(repository, tag)); err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"tag": tag,
+				"err": err,
+			}).Error("Failed to delete reference")
+			continue
+		}
+		ctxLogger.WithField("tag", tag).Info("Removed tag")
+	}
+
+	if digest != "" && tag == "" {
+		wc.ImagePruned(digest)
+	}
+}
@@ -0,0 +1,107 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+const testDigest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+// POST an envelope holding a single event, returning the response status
+func postNotification(wc *watchClient, token, event string) int {
+	body := strings.NewReader(`{"events": [` + event + `]}`)
+	r, _ := http.NewRequest("POST", notifyPath, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	wc.handleNotifications(w, r)
+	return w.Code
+}
+
+func TestHandleNotificationsToken(t *testing.T) {
+	pull := `{"action": "pull", "target": {"repository": "library/busybox", "digest": "` + testDigest + `"}}`
+
+	wc := &watchClient{NotifyToken: "secret"}
+	for token, code := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		if got := postNotification(wc, token, pull); got != code {
+			t.Errorf("With token %q, expected %d, got %d", token, code, got)
+		}
+	}
+
+	// Without a token, only an explicit opt-out lets notifications in
+	if got := postNotification(&watchClient{}, "", pull); got != http.StatusUnauthorized {
+		t.Errorf("Expected an unset token to reject notifications, got %d", got)
+	}
+	if got := postNotification(&watchClient{NotifyInsecure: true}, "", pull); got != http.StatusOK {
+		t.Errorf("Expected authentication to be disabled, got %d", got)
+	}
+}
+
+func TestHandleNotificationsRejectsBadInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Something the bad events would delete if they got through
+	victim := path.Join(dir, "victim")
+	if err := os.Mkdir(victim, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wc := &watchClient{
+		NotifyToken:  "secret",
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: path.Join(dir, "explode")},
+	}
+	for _, event := range []string{
+		`{"action": "delete", "target": {"repository": "library/busybox", "digest": "sha256:../../../victim"}}`,
+		`{"action": "delete", "target": {"repository": "../../victim", "tag": "latest"}}`,
+		`{"action": "delete", "target": {"repository": "library/busybox", "tag": "../../../../victim"}}`,
+		`{"action": "delete", "target": {"repository": "library/busybox", "digest": "sha256:abc"}}`,
+		`{"action": "delete", "target": {"repository": "library/busybox"}}`,
+		`{"action": "push", "target": {"digest": "` + testDigest + `"}}`,
+	} {
+		if got := postNotification(wc, "secret", event); got != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", event, got)
+		}
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("Expected %s to survive, got %v", victim, err)
+	}
+}
+
+func TestRemoveRefStaysInside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: path.Join(dir, "explode")}}
+	if err := os.MkdirAll(path.Join(dir, "victim"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.removeRef("../../victim"); err == nil {
+		t.Error("Expected a ref outside images/ to be refused")
+	}
+	if err := wc.removeDigestLocked("sha256:../../../victim"); err == nil {
+		t.Error("Expected a digest outside digest/ to be refused")
+	}
+	if _, err := os.Stat(path.Join(dir, "victim")); err != nil {
+		t.Errorf("Expected victim to survive, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	dtar "github.com/docker/docker/pkg/archive"
+)
+
+// The outcome of a one-shot explode, printed as JSON by os-explode explode
+// and os-explode import
+type ExplodeSummary struct {
+	// The reference or archive as given
+	Reference string `json:"reference"`
+	// The image reference updated under images/, if a tag was given
+	Ref    string `json:"ref,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// Where the digest was found: "api", "manifest" or "archive"
+	ResolvedBy string `json:"resolvedBy,omitempty"`
+	// Whether the image had been exploded already
+	Cached   bool     `json:"cached"`
+	Layers   []string `json:"layers,omitempty"`
+	Rootfs   string   `json:"rootfs,omitempty"`
+	Duration string   `json:"duration"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Split a one-shot reference, <namespace>/<name>:<tag> or
+// <namespace>/<name>@<digest>, into its repository and tag or digest. The
+// tag defaults to latest.
+func parseReference(reference string) (repository, tag, digest string, err error) {
+	repository = reference
+	if i := strings.Index(reference, "@"); i >= 0 {
+		repository, digest = reference[:i], reference[i+1:]
+		if !digestRegexp.MatchString(digest) {
+			return "", "", "", fmt.Errorf("invalid digest %q", digest)
+		}
+	} else if i := strings.LastIndex(reference, ":"); i >= 0 {
+		repository, tag = reference[:i], reference[i+1:]
+	} else {
+		tag = "latest"
+	}
+
+	parts := strings.Split(repository, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(repository, ":") || (digest == "" && tag == "") {
+		return "", "", "", fmt.Errorf("invalid reference %q, expected <namespace>/<name>:<tag> or <namespace>/<name>@<digest>", reference)
+	}
+	return repository, tag, digest, nil
+}
+
+// Resolve a tag of the given repository (<namespace>/<name>) to a digest,
+// through its ImageStreamTag or, without the Kubernetes API, through the
+// blob source's manifest. Also returns which of the two was used.
+func (wc *watchClient) resolveTag(repository, tag string) (string, string, error) {
+	if wc.Client == nil {
+		digest, err := wc.manifestDigest(repository, tag)
+		return digest, "manifest", err
+	}
+	ist, err := wc.Client.ImageStreamTags(path.Dir(repository)).Get(path.Base(repository), tag)
+	if err != nil {
+		return "", "api", err
+	}
+	return ist.Image.Name, "api", nil
+}
+
+// Explode a single reference synchronously, outside of any watch, and
+// point its ref at it if a tag was given
+func (wc *watchClient) ExplodeOnce(reference string) *ExplodeSummary {
+	start := time.Now()
+	summary := &ExplodeSummary{Reference: reference}
+	defer func() {
+		summary.Duration = time.Since(start).String()
+	}()
+
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType": "EXPLODE",
+		"reference": reference,
+	})
+
+	repository, tag, digest, err := parseReference(reference)
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	if digest == "" {
+		digest, summary.ResolvedBy, err = wc.resolveTag(repository, tag)
+		if err != nil {
+			ctxLogger.WithField("err", err).Error("Could not resolve tag")
+			summary.Error = err.Error()
+			return summary
+		}
+	}
+	wc.explodeForSummary(summary, repository, tag, digest, triggerExplode)
+	return summary
+}
+
+// Explode the image of a `docker save` or OCI archive file, which may be
+// compressed, and point the given ref (<namespace>/<name>:<tag>) at it, if
+// any. The archive must hold a single image.
+func (wc *watchClient) ImportArchive(file, reference string) *ExplodeSummary {
+	start := time.Now()
+	summary := &ExplodeSummary{Reference: file, ResolvedBy: "archive"}
+	defer func() {
+		summary.Duration = time.Since(start).String()
+	}()
+
+	var repository, tag string
+	if reference != "" {
+		var digest string
+		var err error
+		repository, tag, digest, err = parseReference(reference)
+		if err == nil && digest != "" {
+			err = fmt.Errorf("invalid reference %q, expected <namespace>/<name>:<tag>", reference)
+		}
+		if err != nil {
+			summary.Error = err.Error()
+			return summary
+		}
+	}
+
+	a, err := wc.openArchive(file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"eventType": "IMPORT",
+			"archive":   file,
+			"err":       err,
+		}).Error("Could not read archive")
+		summary.Error = err.Error()
+		return summary
+	}
+	defer a.Close()
+	if len(a.images) != 1 {
+		summary.Error = fmt.Sprintf("archive holds %d images, expected one", len(a.images))
+		return summary
+	}
+
+	wc.registerArchive(a)
+	defer wc.unregisterArchive(a)
+	wc.explodeForSummary(summary, repository, tag, a.images[0].ID, triggerArchive)
+	return summary
+}
+
+// Unpack an archive file, decompressing it if need be
+func (wc *watchClient) openArchive(file string) (*imageArchive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stream, err := dtar.DecompressStream(f)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return wc.unpackArchive(stream)
+}
+
+// Explode a digest synchronously, pointing the ref of a tag at it if one is
+// given, and fill in the summary of a one-shot explode
+func (wc *watchClient) explodeForSummary(summary *ExplodeSummary, repository, tag, digest, trigger string) {
+	summary.Digest = digest
+
+	rootfs := path.Join(wc.digestPath(digest), "rootfs")
+	_, err := os.Stat(rootfs)
+	summary.Cached = err == nil
+
+	if tag != "" {
+		summary.Ref = path.Join(repository, tag)
+		err = wc.explode(summary.Ref, digest, trigger)
+	} else {
+		err = wc.explodeDigest(repository, digest)
+	}
+	if err != nil {
+		summary.Error = err.Error()
+		return
+	}
+
+	summary.Rootfs = rootfs
+	if md, err := wc.readImageMetadata(digest); err == nil {
+		summary.Layers = md.Layers
+	}
+}
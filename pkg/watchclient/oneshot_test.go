@@ -0,0 +1,30 @@
+package watchclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	valid := "sha256:" + strings.Repeat("a", 64)
+	cases := []struct {
+		reference, repository, tag, digest string
+	}{
+		{"myproject/app:v1", "myproject/app", "v1", ""},
+		{"myproject/app", "myproject/app", "latest", ""},
+		{"myproject/app@" + valid, "myproject/app", "", valid},
+		{"myproject/app:v1@" + valid, "", "", ""},
+		{"myproject/app@aaaa", "", "", ""},
+		{"myproject/app@sha256:a", "", "", ""},
+		{"myproject/app@sha256:../../images", "", "", ""},
+		{"myproject/app:", "", "", ""},
+		{"app:v1", "", "", ""},
+		{"registry:5000/myproject/app:v1", "", "", ""},
+	}
+	for _, c := range cases {
+		repository, tag, digest, err := parseReference(c.reference)
+		if (err != nil) != (c.repository == "") || repository != c.repository || tag != c.tag || digest != c.digest {
+			t.Errorf("parseReference(%q) = %q, %q, %q, %v", c.reference, repository, tag, digest, err)
+		}
+	}
+}
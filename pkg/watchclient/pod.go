@@ -0,0 +1,147 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// The prefix of a container's imageID when it was pulled by digest. Other
+// imageIDs (docker://<image id>) don't name a manifest.
+const pullableImageIDPrefix = "docker-pullable://"
+
+// Watch the server for Pod events, exploding the images their containers
+// run. Only the Pods of one node are watched if NodeName is set.
+func (wc *watchClient) WatchPods() {
+	selector := fields.Everything()
+	if wc.NodeName != "" {
+		selector = fields.OneTermEqualSelector("spec.nodeName", wc.NodeName)
+	}
+
+	// Make sure we have permission to list Pods
+	if _, err := wc.KubeClient.Pods(kapi.NamespaceAll).List(kapi.ListOptions{FieldSelector: selector}); err != nil {
+		wc.Logger.WithField("err", err).Fatal("Client does not have appropriate privileges")
+	}
+
+	_, controller := framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(opts kapi.ListOptions) (runtime.Object, error) {
+				opts.FieldSelector = selector
+				return wc.KubeClient.Pods(kapi.NamespaceAll).List(opts)
+			},
+			WatchFunc: func(opts kapi.ListOptions) (watch.Interface, error) {
+				opts.FieldSelector = selector
+				return wc.KubeClient.Pods(kapi.NamespaceAll).Watch(opts)
+			},
+		},
+		&kapi.Pod{},
+		10*time.Minute,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				wc.PodChanged(obj.(*kapi.Pod))
+			},
+			UpdateFunc: func(old, obj interface{}) {
+				wc.PodChanged(obj.(*kapi.Pod))
+			},
+		})
+
+	wc.Logger.WithField("node", wc.NodeName).Info("Watching Pods...")
+	go controller.Run(wait.NeverStop)
+}
+
+// Handle an ADDED or UPDATED pod, exploding the images its containers
+// resolved to which aren't exploded yet
+func (wc *watchClient) PodChanged(pod *kapi.Pod) {
+	if !wc.namespaceWatched(pod.Namespace) {
+		return
+	}
+
+	// Don't append to the slices of the cached Pod
+	var statuses []kapi.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		repository, digest, ok := wc.podImage(status.ImageID)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(path.Join(wc.digestPath(digest), "rootfs")); err == nil {
+			// Pods hold no refs, so this marks the digest as last used now
+			// (see lastReferenced)
+			now := time.Now()
+			os.Chtimes(wc.digestPath(digest), now, now)
+			continue
+		}
+		if wc.digestBusy(digest) {
+			// Already being exploded; status updates keep coming while
+			// it runs, and each would otherwise wait on the digest lock
+			continue
+		}
+		log.WithFields(log.Fields{
+			"eventType":  "POD",
+			"pod":        pod.Namespace + "/" + pod.Name,
+			"repository": repository,
+			"digest":     digest,
+		}).Info("New image")
+		go wc.explodeDigest(repository, digest)
+	}
+}
+
+// Resolve the imageID of a container into the repository and digest to
+// explode. Images of the integrated registry are named by <namespace>/<name>;
+// other images keep their registry host, and are only resolved if a pod
+// registry source is set to read them from.
+func (wc *watchClient) podImage(imageID string) (repository, digest string, ok bool) {
+	if !strings.HasPrefix(imageID, pullableImageIDPrefix) {
+		return "", "", false
+	}
+	ref := strings.TrimPrefix(imageID, pullableImageIDPrefix)
+	i := strings.LastIndex(ref, "@")
+	if i < 0 {
+		return "", "", false
+	}
+	name, digest := ref[:i], ref[i+1:]
+
+	if strings.HasPrefix(name, wc.Registry+"/") {
+		return strings.TrimPrefix(name, wc.Registry+"/"), digest, true
+	}
+	if wc.PodRegistrySource == nil {
+		return "", "", false
+	}
+	if !hasRegistryHost(name) {
+		// Docker Hub images may be named without their host
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+		name = "docker.io/" + name
+	}
+	return name, digest, true
+}
@@ -0,0 +1,133 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestPodImage(t *testing.T) {
+	wc := &watchClient{
+		Registry:          "172.30.1.1:5000",
+		PodRegistrySource: &url.URL{Scheme: "https", Host: "mirror.example.com"},
+	}
+	cases := []struct {
+		imageID    string
+		repository string
+		ok         bool
+	}{
+		{"docker-pullable://172.30.1.1:5000/myproject/app@sha256:aaaa", "myproject/app", true},
+		{"docker-pullable://quay.io/coreos/etcd@sha256:aaaa", "quay.io/coreos/etcd", true},
+		{"docker-pullable://fedora@sha256:aaaa", "docker.io/library/fedora", true},
+		{"docker://sha256:aaaa", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		repository, digest, ok := wc.podImage(c.imageID)
+		if ok != c.ok || repository != c.repository || (ok && digest != "sha256:aaaa") {
+			t.Errorf("podImage(%q) = %q, %q, %v", c.imageID, repository, digest, ok)
+		}
+	}
+}
+
+func TestPodImageWithoutRegistrySource(t *testing.T) {
+	wc := &watchClient{Registry: "172.30.1.1:5000"}
+	if _, _, ok := wc.podImage("docker-pullable://quay.io/coreos/etcd@sha256:aaaa"); ok {
+		t.Error("Expected images of other registries to be skipped")
+	}
+}
+
+func TestBlobSourceFor(t *testing.T) {
+	local := &url.URL{Scheme: "file", Path: "/registry"}
+	mirror := &url.URL{Scheme: "https", Host: "mirror.example.com"}
+	wc := &watchClient{BlobSource: local, PodRegistrySource: mirror}
+
+	if source, repository := wc.blobSourceFor("myproject/app"); source != local || repository != "myproject/app" {
+		t.Errorf("Expected myproject/app from the blob source, got %s from %s", repository, source)
+	}
+	if source, repository := wc.blobSourceFor("docker.io/library/fedora"); source != mirror || repository != "library/fedora" {
+		t.Errorf("Expected library/fedora from the mirror, got %s from %s", repository, source)
+	}
+}
+
+func TestGetCredentials(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	registry, _ := url.Parse(server.URL)
+	mirror, _ := url.Parse(server.URL)
+	wc := &watchClient{
+		BlobSource:        registry,
+		PodRegistrySource: mirror,
+		Token:             "secret",
+		BlobClient:        http.DefaultClient,
+	}
+	cases := []struct {
+		source     *url.URL
+		mirrorAuth *url.Userinfo
+		expected   string
+	}{
+		{registry, nil, "Basic ZXhwbG9kZXI6c2VjcmV0"},
+		{mirror, nil, ""},
+		{mirror, url.UserPassword("puller", "hunter2"), "Basic cHVsbGVyOmh1bnRlcjI="},
+	}
+	for _, c := range cases {
+		wc.PodRegistryAuth = c.mirrorAuth
+		resp, err := wc.get(c.source, "v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if auth != c.expected {
+			t.Errorf("Expected %q to be sent to %s, got %q", c.expected, c.source, auth)
+		}
+	}
+}
+
+func TestPodChangedSkipsBusyDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pod-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		Registry:     "172.30.1.1:5000",
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+	}
+	pod := &kapi.Pod{
+		ObjectMeta: kapi.ObjectMeta{Namespace: "myproject", Name: "app-1"},
+		Status: kapi.PodStatus{
+			ContainerStatuses: []kapi.ContainerStatus{
+				{ImageID: "docker-pullable://172.30.1.1:5000/myproject/app@sha256:aaaa"},
+			},
+		},
+	}
+
+	// An explode of the digest is running; updates of the pod's status
+	// must not queue more behind it
+	unlock := wc.lockDigest("sha256:aaaa")
+	defer unlock()
+	for i := 0; i < 3; i++ {
+		wc.PodChanged(pod)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	wc.digestLocksMu.Lock()
+	users := wc.digestLocks["sha256:aaaa"].users
+	wc.digestLocksMu.Unlock()
+	if users != 1 {
+		t.Errorf("Expected no explode waiting on the digest, got %d users", users-1)
+	}
+}
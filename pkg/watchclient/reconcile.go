@@ -0,0 +1,165 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// Unreferenced digests changed more recently than this are left alone, as
+// their explode may still be about to write a ref
+const orphanGracePeriod = 10 * time.Minute
+
+// Bring images/ and digest/ in line with a list of the ImageStreams of a
+// namespace (or of all of them): remove the refs of tags and streams which
+// are gone, queue explodes for tags whose ref is missing or out of date,
+// and remove digests which nothing refers to anymore
+func (wc *watchClient) reconcile(namespace string, list []imageapi.ImageStream) {
+	ctxLogger := log.WithFields(log.Fields{
+		"eventType": "RECONCILE",
+		"namespace": namespace,
+	})
+
+	streams := make(map[string]*imageapi.ImageStream)
+	for i := range list {
+		is := &list[i]
+		streams[path.Join(is.Namespace, is.Name)] = is
+	}
+
+	namespaces := []string{namespace}
+	if namespace == kapi.NamespaceAll {
+		namespaces = subdirs(path.Join(wc.OSTreeConfig.BasePath, "images"))
+	}
+
+	removed := 0
+	for _, ns := range namespaces {
+		if !wc.namespaceWatched(ns) {
+			continue
+		}
+		for _, name := range subdirs(path.Join(wc.OSTreeConfig.BasePath, "images", ns)) {
+			is := streams[path.Join(ns, name)]
+			for _, tag := range wc.recordedTags(ns, name) {
+				if is != nil {
+					if _, ok := is.Status.Tags[tag]; ok {
+						continue
+					}
+				}
+				imgref := path.Join(ns, name, tag)
+				if err := wc.removeRef(imgref); err != nil {
+					ctxLogger.WithFields(log.Fields{
+						"ref": imgref,
+						"err": err,
+					}).Error("Failed to delete reference")
+					continue
+				}
+				ctxLogger.WithField("ref", imgref).Info("Removed stale ref")
+				removed++
+			}
+		}
+	}
+
+	queued := 0
+	for _, is := range streams {
+		if !wc.namespaceWatched(is.Namespace) || !wc.streamEnabled(is) {
+			continue
+		}
+		for tag, events := range is.Status.Tags {
+			if len(events.Items) == 0 || !wc.tagEnabled(is, tag) ||
+				!wc.explodable(events.Items[0].DockerImageReference) {
+				continue
+			}
+			imgref := getFullRef(is, tag)
+			digest := events.Items[0].Image
+			if readLink(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link")) != digest {
+				ctxLogger.WithField("ref", imgref).Info("Queued missing explode")
+				go wc.explode(imgref, digest, tagTrigger(is, tag))
+				queued++
+			}
+		}
+	}
+
+	// Pods explode digests without refs, which aren't orphans
+	pruned := 0
+	if !wc.PodSource {
+		pruned = wc.removeOrphanDigests()
+	}
+
+	ctxLogger.WithFields(log.Fields{
+		"removedRefs":    removed,
+		"queuedExplodes": queued,
+		"removedDigests": pruned,
+	}).Info("Reconciled")
+}
+
+// Collect the digests linked to from images/, by links and history entries
+func (wc *watchClient) referencedDigests() map[string]bool {
+	referenced := make(map[string]bool)
+	imagespath := path.Join(wc.OSTreeConfig.BasePath, "images")
+	for _, ns := range subdirs(imagespath) {
+		for _, name := range subdirs(path.Join(imagespath, ns)) {
+			for _, tag := range wc.recordedTags(ns, name) {
+				for _, digest := range wc.recordedDigests(path.Join(ns, name, tag)) {
+					referenced[digest] = true
+				}
+			}
+		}
+	}
+	return referenced
+}
+
+// Remove the exploded digests nothing links to, returning how many were
+// removed. Digests being exploded, or changed within orphanGracePeriod,
+// are left alone.
+func (wc *watchClient) removeOrphanDigests() int {
+	referenced := wc.referencedDigests()
+	digestpath := path.Join(wc.OSTreeConfig.BasePath, "digest")
+
+	removed := 0
+	for _, alg := range subdirs(digestpath) {
+		for _, hex := range subdirs(path.Join(digestpath, alg)) {
+			digest := alg + ":" + hex
+			if referenced[digest] || wc.digestBusy(digest) {
+				continue
+			}
+			info, err := os.Stat(path.Join(digestpath, alg, hex))
+			if err != nil || time.Since(info.ModTime()) < orphanGracePeriod {
+				continue
+			}
+			if refs, err := wc.removeUnreferencedDigest(digest); err != nil {
+				log.WithFields(log.Fields{
+					"digest": digest,
+					"err":    err,
+				}).Error("Failed to delete image")
+				continue
+			} else if len(refs) > 0 {
+				continue
+			}
+			log.WithField("digest", digest).Info("Removed orphaned digest")
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,79 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconcile-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+		Registry:     "172.30.1.1:5000",
+	}
+
+	// The ref of latest is current; old was untagged and gone was deleted
+	// while we weren't watching, and nothing ever referred to dddd
+	refs := map[string]string{
+		"myproject/app/latest":  "sha256:aaaa",
+		"myproject/app/old":     "sha256:bbbb",
+		"myproject/gone/latest": "sha256:cccc",
+	}
+	for imgref, digest := range refs {
+		if err := wc.updateRef(imgref, digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * orphanGracePeriod)
+	for _, digest := range []string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc", "sha256:dddd"} {
+		if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(wc.digestPath(digest), past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	is := streamWithTags(nil)
+	is.Namespace, is.Name = "myproject", "app"
+	is.Annotations = map[string]string{
+		enabledAnnotation: "true",
+		tagsAnnotation:    "*",
+	}
+	is.Status.Tags["latest"] = imageapi.TagEventList{Items: []imageapi.TagEvent{{
+		Image:                "sha256:aaaa",
+		DockerImageReference: "172.30.1.1:5000/myproject/app@sha256:aaaa",
+	}}}
+	wc.reconcile(kapi.NamespaceAll, []imageapi.ImageStream{*is})
+
+	if readLink(path.Join(dir, "images/myproject/app/latest/link")) != "sha256:aaaa" {
+		t.Error("Current ref was removed")
+	}
+	for _, imgref := range []string{"myproject/app/old", "myproject/gone"} {
+		if _, err := os.Stat(path.Join(dir, "images", imgref)); !os.IsNotExist(err) {
+			t.Errorf("Stale ref %s was kept", imgref)
+		}
+	}
+	if _, err := os.Stat(wc.digestPath("sha256:aaaa")); err != nil {
+		t.Error("Referenced digest was removed")
+	}
+	for _, digest := range []string{"sha256:bbbb", "sha256:cccc", "sha256:dddd"} {
+		if _, err := os.Stat(wc.digestPath(digest)); !os.IsNotExist(err) {
+			t.Errorf("Orphaned digest %s was kept", digest)
+		}
+	}
+}
@@ -18,8 +18,12 @@
 package watchclient
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -33,6 +37,11 @@ func getFullRef(is *imageapi.ImageStream, tag string) string {
 	return path.Join(is.ObjectMeta.Namespace, is.ObjectMeta.Name, tag)
 }
 
+// Get the directory into which a digest is exploded
+func (wc *watchClient) digestPath(digest string) string {
+	return path.Join(wc.OSTreeConfig.BasePath, "digest", strings.Join(strings.SplitN(digest, ":", 2), "/"))
+}
+
 // Get the digest commited into a branch
 func (wc *watchClient) digestForRef(imgref string) string {
 	file, err := os.OpenFile(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link"), os.O_CREATE, 0744)
@@ -56,7 +65,11 @@ func (wc *watchClient) digestForRef(imgref string) string {
 //Update an image reference to point to a new digest
 func (wc *watchClient) updateRef(imgref, digest string) error {
 	//TODO: locking
-	lpath := path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link")
+	return wc.setLink(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link"), digest)
+}
+
+// Write a link file, which holds a digest
+func writeLink(lpath, digest string) error {
 	os.MkdirAll(path.Dir(lpath), 0755)
 	file, err := os.OpenFile(lpath, os.O_CREATE+os.O_RDWR, 0744)
 	if err != nil {
@@ -73,3 +86,131 @@ func (wc *watchClient) updateRef(imgref, digest string) error {
 
 	return nil
 }
+
+// Read the digest held by a link file, or "" if there is none
+func readLink(lpath string) string {
+	digest, err := ioutil.ReadFile(lpath)
+	if err != nil {
+		return ""
+	}
+	return string(digest)
+}
+
+// Remove an image reference, along with any directories it leaves empty
+func (wc *watchClient) removeRef(imgref string) error {
+	// TODO: locking
+	basepath := path.Join(wc.OSTreeConfig.BasePath, "images")
+	refpath := path.Join(basepath, imgref)
+	if !isUnder(refpath, basepath) {
+		return fmt.Errorf("reference %s is outside %s", imgref, basepath)
+	}
+	filepath.Walk(refpath, func(p string, info os.FileInfo, err error) error {
+		if err == nil && isLinkFile(p, info) {
+			if digest := readLink(p); digest != "" {
+				wc.unindexRef(digest, p)
+			}
+		}
+		return nil
+	})
+	if err := os.RemoveAll(refpath); err != nil {
+		return err
+	}
+	removeEmptyParents(path.Dir(refpath), basepath)
+	return nil
+}
+
+// Determine whether a path lies under a directory, the directory excluded
+func isUnder(p, dir string) bool {
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// Remove the directories from dir up to basepath which were left empty,
+// stopping at basepath or as soon as dir isn't under it
+func removeEmptyParents(dir, basepath string) {
+	for isUnder(dir, basepath) {
+		os.Remove(dir)
+		dir = path.Dir(dir)
+	}
+}
+
+// List the tags recorded on disk for an image stream
+func (wc *watchClient) recordedTags(namespace, name string) []string {
+	return subdirs(path.Join(wc.OSTreeConfig.BasePath, "images", namespace, name))
+}
+
+// List the names of the directories within a directory
+func subdirs(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// List the digests an image reference points at: its link, followed by
+// any history entries
+func (wc *watchClient) recordedDigests(imgref string) []string {
+	var digests []string
+	if digest := readLink(path.Join(wc.OSTreeConfig.BasePath, "images", imgref, "link")); digest != "" {
+		digests = append(digests, digest)
+	}
+	return append(digests, wc.historyDigests(imgref)...)
+}
+
+// Remove an exploded digest unless a link file still points to it,
+// returning the link files which do
+func (wc *watchClient) removeUnreferencedDigest(digest string) ([]string, error) {
+	unlock := wc.lockDigest(digest)
+	defer unlock()
+
+	if refs := wc.digestRefs(digest); len(refs) > 0 {
+		return refs, nil
+	}
+	return nil, wc.removeDigestLocked(digest)
+}
+
+// Remove the exploded digests among the given ones which no link file
+// points to anymore, e.g. once refs to them were removed or moved.
+// Failures are logged.
+func (wc *watchClient) removeUnreferencedDigests(digests []string, ctxLogger *log.Entry) {
+	seen := make(map[string]bool)
+	for _, digest := range digests {
+		if seen[digest] {
+			continue
+		}
+		seen[digest] = true
+		refs, err := wc.removeUnreferencedDigest(digest)
+		if err != nil {
+			ctxLogger.WithFields(log.Fields{
+				"digest": digest,
+				"err":    err,
+			}).Error("Failed to delete image")
+		} else if len(refs) > 0 {
+			ctxLogger.WithFields(log.Fields{
+				"digest": digest,
+				"refs":   refs,
+			}).Debug("Image still referenced, keeping it")
+		}
+	}
+}
+
+// Remove an exploded digest whose lock is held, along with any
+// directories it leaves empty
+func (wc *watchClient) removeDigestLocked(digest string) error {
+	basepath := path.Join(wc.OSTreeConfig.BasePath, "digest")
+	imgpath := wc.digestPath(digest)
+	if !isUnder(imgpath, basepath) {
+		return fmt.Errorf("digest %s is outside %s", digest, basepath)
+	}
+	if err := os.RemoveAll(imgpath); err != nil {
+		return err
+	}
+	removeEmptyParents(path.Dir(imgpath), basepath)
+	return nil
+}
@@ -0,0 +1,147 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The directory of an exploded digest indexing the link files under
+// images/ which point to it, one empty file per link named by its escaped
+// path within images/
+const refIndexDir = "refs"
+
+// Get the index entry recording that a link file points to a digest
+func (wc *watchClient) refIndexEntry(digest, lpath string) string {
+	rel := strings.TrimPrefix(lpath, path.Join(wc.OSTreeConfig.BasePath, "images")+"/")
+	return path.Join(wc.digestPath(digest), refIndexDir, url.QueryEscape(rel))
+}
+
+// Record that a link file points to a digest. The index is created even if
+// the digest isn't exploded yet, so that a digest still being exploded is
+// known to be in use.
+func (wc *watchClient) indexRef(digest, lpath string) {
+	unlock := wc.lockDigest(digest)
+	defer unlock()
+
+	entry := wc.refIndexEntry(digest, lpath)
+	os.MkdirAll(path.Dir(entry), 0755)
+	if err := ioutil.WriteFile(entry, nil, 0644); err != nil {
+		log.WithFields(log.Fields{
+			"digest": digest,
+			"link":   lpath,
+			"err":    err,
+		}).Warn("Could not index reference")
+	}
+}
+
+// Drop the record that a link file points to a digest
+func (wc *watchClient) unindexRef(digest, lpath string) {
+	unlock := wc.lockDigest(digest)
+	defer unlock()
+	os.Remove(wc.refIndexEntry(digest, lpath))
+}
+
+// List the link files, relative to images/, which point to a digest
+func (wc *watchClient) digestRefs(digest string) []string {
+	entries, _ := ioutil.ReadDir(path.Join(wc.digestPath(digest), refIndexDir))
+	var refs []string
+	for _, entry := range entries {
+		if rel, err := url.QueryUnescape(entry.Name()); err == nil {
+			refs = append(refs, rel)
+		}
+	}
+	return refs
+}
+
+// Point a link file at a digest, moving its index entry over
+func (wc *watchClient) setLink(lpath, digest string) error {
+	old := readLink(lpath)
+	if err := writeLink(lpath, digest); err != nil {
+		return err
+	}
+	wc.indexRef(digest, lpath)
+	if old != "" && old != digest {
+		wc.unindexRef(old, lpath)
+	}
+	return nil
+}
+
+// Remove a link file along with its index entry
+func (wc *watchClient) removeLink(lpath string) error {
+	digest := readLink(lpath)
+	if err := os.Remove(lpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if digest != "" {
+		wc.unindexRef(digest, lpath)
+	}
+	return nil
+}
+
+// Determine whether a file under images/ is a link file: the link of a ref,
+// or one of its history entries
+func isLinkFile(p string, info os.FileInfo) bool {
+	return !info.IsDir() && (info.Name() == "link" || path.Base(path.Dir(p)) == "history")
+}
+
+// Rebuild the reference index from the link files under images/, e.g. for
+// trees exploded before it existed or changed while we weren't running.
+// Must run before anything explodes or removes refs. Modification times
+// are kept, as retention tells from them how long digests were unused.
+func (wc *watchClient) IndexRefs() {
+	digestpath := path.Join(wc.OSTreeConfig.BasePath, "digest")
+	mtimes := make(map[string]time.Time)
+	for _, alg := range subdirs(digestpath) {
+		for _, hex := range subdirs(path.Join(digestpath, alg)) {
+			dir := path.Join(digestpath, alg, hex)
+			for _, p := range []string{dir, path.Join(dir, refIndexDir)} {
+				if info, err := os.Stat(p); err == nil {
+					mtimes[p] = info.ModTime()
+				}
+			}
+			os.RemoveAll(path.Join(dir, refIndexDir))
+		}
+	}
+	defer func() {
+		for p, mtime := range mtimes {
+			os.Chtimes(p, mtime, mtime)
+		}
+	}()
+
+	indexed := 0
+	filepath.Walk(path.Join(wc.OSTreeConfig.BasePath, "images"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || !isLinkFile(p, info) {
+			return nil
+		}
+		if digest := readLink(p); digest != "" {
+			wc.indexRef(digest, p)
+			indexed++
+		}
+		return nil
+	})
+	log.WithField("links", indexed).Info("Indexed references")
+}
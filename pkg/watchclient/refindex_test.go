@@ -0,0 +1,109 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestSharedDigestOutlivesStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refindex-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	digest := "sha256:aaaa"
+	if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image was tagged from one project into another. The second ref
+	// was written behind our back, so only rebuilding the index finds it.
+	if err := wc.updateRef("myproject/app/latest", digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLink(path.Join(dir, "images/otherproject/app/v1/link"), digest); err != nil {
+		t.Fatal(err)
+	}
+	if refs := wc.digestRefs(digest); len(refs) != 1 {
+		t.Fatalf("Expected one indexed ref, got %v", refs)
+	}
+	wc.IndexRefs()
+	if refs := wc.digestRefs(digest); len(refs) != 2 {
+		t.Fatalf("Expected two indexed refs, got %v", refs)
+	}
+
+	wc.ImageDeleted(&imageapi.ImageStream{ObjectMeta: kapi.ObjectMeta{Namespace: "myproject", Name: "app"}})
+	if _, err := os.Stat(wc.digestPath(digest)); err != nil {
+		t.Fatal("Digest still tagged elsewhere was removed")
+	}
+	if refs := wc.digestRefs(digest); len(refs) != 1 || refs[0] != "otherproject/app/v1/link" {
+		t.Errorf("Expected the other ref to remain indexed, got %v", refs)
+	}
+
+	wc.ImageDeleted(&imageapi.ImageStream{ObjectMeta: kapi.ObjectMeta{Namespace: "otherproject", Name: "app"}})
+	if _, err := os.Stat(wc.digestPath(digest)); err == nil {
+		t.Error("Digest was kept after its last ref went away")
+	}
+}
+
+func TestRefToUnexplodedDigestIndexed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refindex-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The digest is still being exploded when the ref is written
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	digest := "sha256:aaaa"
+	if err := wc.updateRef("myproject/app/latest", digest); err != nil {
+		t.Fatal(err)
+	}
+	if refs := wc.digestRefs(digest); len(refs) != 1 {
+		t.Fatalf("Expected the ref to be indexed, got %v", refs)
+	}
+
+	if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := wc.removeUnreferencedDigest(digest); err != nil || len(refs) != 1 {
+		t.Fatalf("Expected the digest to be kept for its ref, got %v, %v", refs, err)
+	}
+	if _, err := os.Stat(path.Join(wc.digestPath(digest), "rootfs")); err != nil {
+		t.Error("Expected the digest to be kept")
+	}
+}
+
+func TestExplodeForLinkIndexesFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refindex-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir}}
+	digest := "sha256:aaaa"
+	if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The explode is done but the link isn't written yet, as when a tag
+	// moves away from the digest in the meantime
+	link := path.Join(dir, "images/myproject/app/latest/link")
+	if err := wc.explodeForLink("myproject/app", digest, link); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := wc.removeUnreferencedDigest(digest); err != nil || len(refs) != 1 {
+		t.Fatalf("Expected the digest to be kept for its pending link, got %v, %v", refs, err)
+	}
+}
@@ -0,0 +1,252 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Project annotations overriding the retention policy of its namespace
+const retainDigestsAnnotation = "exploder.openshift.io/retain-digests"
+const retainTagsAnnotation = "exploder.openshift.io/retain-tags"
+
+// What to keep exploded. Zero values keep everything.
+type retentionPolicy struct {
+	// The number of distinct digests to keep per tag, the current one
+	// included
+	KeepDigests int
+	// Globs of the tags whose digests are kept forever
+	KeepTags []string
+	// How long exploded trees nothing refers to are kept. Only set
+	// globally, as such trees belong to no namespace.
+	UnreferencedFor time.Duration
+}
+
+// Determine whether a policy keeps every digest of a tag
+func (p retentionPolicy) keepsForever(tag string) bool {
+	return matchesAny(p.KeepTags, tag)
+}
+
+// Get the retention policy of a namespace: the global one, overridden by
+// the annotations of its Project
+func (wc *watchClient) retentionFor(namespace string) retentionPolicy {
+	policy := wc.Retention
+	if wc.Client == nil {
+		return policy
+	}
+	annotations := wc.namespaceAnnotations(namespace)
+	if raw, ok := annotations[retainDigestsAnnotation]; ok {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			policy.KeepDigests = n
+			if n > 0 && wc.HistoryDepth <= 1 {
+				log.WithFields(log.Fields{
+					"namespace":  namespace,
+					"annotation": retainDigestsAnnotation,
+					"value":      raw,
+				}).Warnf("Annotation has no effect unless %s is greater than 1", historyDepthEnv)
+			}
+		} else {
+			log.WithFields(log.Fields{
+				"namespace":  namespace,
+				"annotation": retainDigestsAnnotation,
+				"value":      raw,
+			}).Warn("Ignoring invalid annotation")
+		}
+	}
+	if raw, ok := annotations[retainTagsAnnotation]; ok {
+		policy.KeepTags = splitList(raw)
+	}
+	return policy
+}
+
+// The outcome of applying the retention policies, printed as JSON by
+// os-explode retention
+type RetentionReport struct {
+	DryRun bool `json:"dryRun"`
+	// What was (or, in a dry run, would be) removed, and why
+	Removed  []RetentionDecision `json:"removed"`
+	Kept     int                 `json:"kept"`
+	Duration string              `json:"duration"`
+}
+
+// A link file under images/ or a tree under digest/ to be removed
+type RetentionDecision struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+	Reason string `json:"reason"`
+}
+
+// Pick the history entries of a tag to remove so that no more than keep
+// distinct digests remain, the one of its link included. Entries are named
+// by the generation of their tag event; the newest generations are kept.
+func trimHistory(link string, entries map[string]string, keep int) []string {
+	var names historyOrder
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	kept := make(map[string]bool)
+	if link != "" {
+		kept[link] = true
+	}
+	var remove []string
+	for _, name := range names {
+		digest := entries[name]
+		switch {
+		case kept[digest]:
+		case len(kept) < keep:
+			kept[digest] = true
+		default:
+			remove = append(remove, name)
+		}
+	}
+	return remove
+}
+
+// Apply the retention policies to images/ and digest/: trim the history of
+// each tag to its namespace's number of digests, unless the tag is kept
+// forever, then remove the trees which became or have long been
+// unreferenced. In a dry run, only report what would be removed.
+func (wc *watchClient) ApplyRetention(dryRun bool) *RetentionReport {
+	start := time.Now()
+	report := &RetentionReport{DryRun: dryRun, Removed: []RetentionDecision{}}
+	imagespath := path.Join(wc.OSTreeConfig.BasePath, "images")
+
+	// The refs removed history entries drop from each digest, to tell
+	// which digests lose their last one (and, in a dry run, to discount)
+	dropped := make(map[string]map[string]bool)
+
+	filepath.Walk(imagespath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != "link" {
+			return nil
+		}
+		refdir := path.Dir(p)
+		imgref := strings.TrimPrefix(refdir, imagespath+"/")
+		tag := path.Base(refdir)
+		policy := wc.retentionFor(strings.SplitN(imgref, "/", 2)[0])
+		if policy.KeepDigests == 0 || policy.keepsForever(tag) {
+			return nil
+		}
+
+		histpath := wc.historyPath(imgref)
+		entries := make(map[string]string)
+		files, _ := ioutil.ReadDir(histpath)
+		for _, file := range files {
+			if digest := readLink(path.Join(histpath, file.Name())); digest != "" {
+				entries[file.Name()] = digest
+			}
+		}
+		for _, name := range trimHistory(readLink(p), entries, policy.KeepDigests) {
+			entry := path.Join(histpath, name)
+			rel := strings.TrimPrefix(entry, imagespath+"/")
+			digest := entries[name]
+			report.Removed = append(report.Removed, RetentionDecision{
+				Path:   path.Join("images", rel),
+				Digest: digest,
+				Reason: "beyond the newest " + strconv.Itoa(policy.KeepDigests) + " digests of the tag",
+			})
+			if dropped[digest] == nil {
+				dropped[digest] = make(map[string]bool)
+			}
+			dropped[digest][rel] = true
+			if dryRun {
+				continue
+			}
+			if err := wc.removeLink(entry); err != nil {
+				log.WithFields(log.Fields{
+					"entry": entry,
+					"err":   err,
+				}).Error("Failed to delete history entry")
+			}
+		}
+		return nil
+	})
+
+	digestpath := path.Join(wc.OSTreeConfig.BasePath, "digest")
+	for _, alg := range subdirs(digestpath) {
+		for _, hex := range subdirs(path.Join(digestpath, alg)) {
+			digest := alg + ":" + hex
+			refs := 0
+			for _, ref := range wc.digestRefs(digest) {
+				if !dropped[digest][ref] {
+					refs++
+				}
+			}
+			reason := ""
+			switch {
+			case refs > 0 || wc.digestBusy(digest):
+			case len(dropped[digest]) > 0:
+				reason = "its last ref was removed"
+			case wc.Retention.UnreferencedFor > 0 && time.Since(wc.lastReferenced(digest)) > wc.Retention.UnreferencedFor:
+				reason = "unreferenced for over " + wc.Retention.UnreferencedFor.String()
+			}
+			if reason == "" {
+				report.Kept++
+				continue
+			}
+
+			report.Removed = append(report.Removed, RetentionDecision{
+				Path:   path.Join("digest", alg, hex),
+				Digest: digest,
+				Reason: reason,
+			})
+			if dryRun {
+				continue
+			}
+			if refs, err := wc.removeUnreferencedDigest(digest); err != nil {
+				log.WithFields(log.Fields{
+					"digest": digest,
+					"err":    err,
+				}).Error("Failed to delete image")
+			} else if len(refs) > 0 {
+				report.Kept++
+			}
+		}
+	}
+
+	report.Duration = time.Since(start).String()
+	log.WithFields(log.Fields{
+		"eventType": "RETENTION",
+		"dryRun":    dryRun,
+		"removed":   len(report.Removed),
+		"kept":      report.Kept,
+	}).Info("Applied retention policies")
+	return report
+}
+
+// Get when anything last referred to an exploded digest: when its last
+// ref was dropped from the index or, for digests which never had one
+// (e.g. those of Pods), when the digest was last changed or seen
+func (wc *watchClient) lastReferenced(digest string) time.Time {
+	for _, p := range []string{path.Join(wc.digestPath(digest), refIndexDir), wc.digestPath(digest)} {
+		if info, err := os.Stat(p); err == nil {
+			return info.ModTime()
+		}
+	}
+	return time.Now()
+}
@@ -0,0 +1,101 @@
+package watchclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+func TestTrimHistory(t *testing.T) {
+	entries := map[string]string{
+		"10":  "sha256:dddd",
+		"9.1": "sha256:cccc",
+		"9":   "sha256:dddd",
+		"3":   "sha256:bbbb",
+		"1":   "sha256:aaaa",
+	}
+	cases := map[int][]string{
+		1: {"1", "3", "9.1"},
+		2: {"1", "3"},
+		3: {"1"},
+		5: nil,
+	}
+	for keep, expected := range cases {
+		remove := trimHistory("sha256:dddd", entries, keep)
+		sort.Strings(remove)
+		if !reflect.DeepEqual(remove, expected) {
+			t.Errorf("Keeping %d, expected to remove %v, got %v", keep, expected, remove)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{BasePath: dir},
+		Retention: retentionPolicy{
+			KeepDigests:     2,
+			KeepTags:        []string{"release-*"},
+			UnreferencedFor: time.Hour,
+		},
+	}
+	for _, digest := range []string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc", "sha256:eeee"} {
+		if err := os.MkdirAll(path.Join(wc.digestPath(digest), "rootfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// eeee was last used by a Pod two hours ago
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(wc.digestPath("sha256:eeee"), old, old)
+
+	refs := map[string]string{
+		"myproject/app/latest/link":         "sha256:cccc",
+		"myproject/app/latest/history/3":    "sha256:bbbb",
+		"myproject/app/latest/history/1":    "sha256:aaaa",
+		"myproject/app/release-1/link":      "sha256:cccc",
+		"myproject/app/release-1/history/2": "sha256:bbbb",
+		"myproject/app/release-1/history/1": "sha256:bbbb",
+		"otherproject/app/latest/history/7": "sha256:cccc",
+	}
+	for ref, digest := range refs {
+		if err := wc.setLink(path.Join(dir, "images", ref), digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"digest/sha256/aaaa", "digest/sha256/eeee", "images/myproject/app/latest/history/1"}
+	for _, dryRun := range []bool{true, false} {
+		report := wc.ApplyRetention(dryRun)
+		var removed []string
+		for _, decision := range report.Removed {
+			removed = append(removed, decision.Path)
+		}
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, expected) {
+			t.Errorf("Dry run %v: expected to remove %v, got %v", dryRun, expected, removed)
+		}
+		if report.Kept != 2 {
+			t.Errorf("Dry run %v: expected to keep 2 digests, kept %d", dryRun, report.Kept)
+		}
+	}
+
+	for _, digest := range []string{"sha256:aaaa", "sha256:eeee"} {
+		if _, err := os.Stat(wc.digestPath(digest)); err == nil {
+			t.Errorf("%s was kept", digest)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "images/myproject/app/latest/history/3")); err != nil {
+		t.Error("Newest history entry was removed")
+	}
+}
@@ -0,0 +1,179 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/system"
+)
+
+const selinuxXattr = "security.selinux"
+
+// Number of MCS categories (c0.c1023) to pick per-image pairs from
+const mcsCategories = 1024
+
+// Produce the label for an image from the configured context. A context
+// without a level (user:role:type) gets a per-image MCS pair derived from
+// the digest, e.g. "system_u:object_r:container_file_t:s0:c12,c345". A
+// context with a level is used as-is.
+func selinuxLabelFor(context, digest string) string {
+	if context == "" || strings.Count(context, ":") >= 3 {
+		return context
+	}
+	return context + ":" + mcsPairFor(digest)
+}
+
+// Derive a stable pair of distinct MCS categories from an image digest
+func mcsPairFor(digest string) string {
+	hex := digest[strings.Index(digest, ":")+1:]
+	if len(hex) > 8 {
+		hex = hex[:8]
+	}
+	seed, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		seed = 0
+	}
+
+	first := seed % mcsCategories
+	second := (seed / mcsCategories) % (mcsCategories - 1)
+	if second >= first {
+		second++
+	} else {
+		first, second = second, first
+	}
+	return fmt.Sprintf("s0:c%d,c%d", first, second)
+}
+
+// Label every file in a rootfs. OSTree checks files out as hardlinks into
+// the repo, and objects are shared between images, so linked files are
+// copied first: labeling them in place would relabel the repo object and
+// every other image using it.
+func relabel(rootfs, label string) error {
+	return filepath.Walk(rootfs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !info.IsDir() {
+			if err := breakHardlink(p, info, st); err != nil {
+				return err
+			}
+		}
+		if err := system.Lsetxattr(p, selinuxXattr, []byte(label), 0); err != nil {
+			return fmt.Errorf("could not label %s: %s", p, err)
+		}
+		return nil
+	})
+}
+
+// Replace a hardlinked file by a private copy with the same contents,
+// ownership, mode, xattrs and times.
+func breakHardlink(p string, info os.FileInfo, st *syscall.Stat_t) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, p); err != nil {
+			return err
+		}
+		return os.Lchown(p, int(st.Uid), int(st.Gid))
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	tmp := p + ".relabel"
+	if err := copyFile(p, tmp, info.Mode()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chown(tmp, int(st.Uid), int(st.Gid)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// chown clears setuid/setgid bits, so restore the mode afterwards
+	if err := os.Chmod(tmp, info.Mode()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := copyXattrs(p, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Copy the contents of a regular file
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copy every xattr but the SELinux label from one regular file to another
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(src, names); err != nil {
+		return err
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || string(name) == selinuxXattr {
+			continue
+		}
+		value, err := system.Lgetxattr(src, string(name))
+		if err != nil {
+			return err
+		}
+		if err := system.Lsetxattr(dst, string(name), value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
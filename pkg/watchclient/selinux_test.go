@@ -0,0 +1,87 @@
+package watchclient
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/docker/pkg/system"
+)
+
+const testDigest = "sha256:64a02df6aac27d1200c2572fe4b9949f1970d05f74d367ce4af994ba5dc3669e"
+
+func TestSELinuxLabelWithLevel(t *testing.T) {
+	context := "system_u:object_r:container_file_t:s0:c1,c2"
+	if label := selinuxLabelFor(context, testDigest); label != context {
+		t.Errorf("Expected %s, got %s", context, label)
+	}
+}
+
+func TestSELinuxLabelPerImage(t *testing.T) {
+	context := "system_u:object_r:container_file_t"
+	label := selinuxLabelFor(context, testDigest)
+	if label != context+":"+mcsPairFor(testDigest) {
+		t.Errorf("Unexpected label %s", label)
+	}
+	if label != selinuxLabelFor(context, testDigest) {
+		t.Error("Label is not stable for a digest")
+	}
+}
+
+func TestMCSPairDistinct(t *testing.T) {
+	digests := []string{
+		testDigest,
+		"sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		"sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		"sha256:000003ff00000000000000000000000000000000000000000000000000000000",
+	}
+	for _, digest := range digests {
+		var first, second int
+		if _, err := fmt.Sscanf(mcsPairFor(digest), "s0:c%d,c%d", &first, &second); err != nil {
+			t.Error(err)
+		} else if first >= second || second >= mcsCategories {
+			t.Errorf("Bad MCS pair for %s: c%d,c%d", digest, first, second)
+		}
+	}
+}
+
+func TestRelabelLeavesHardlinksOutside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selinux-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stands in for an OSTree repo object the rootfs is checked out from
+	object := path.Join(dir, "object")
+	if err := ioutil.WriteFile(object, []byte("shared"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := system.Lgetxattr(object, selinuxXattr)
+	rootfs := path.Join(dir, "rootfs")
+	os.Mkdir(rootfs, 0755)
+	if err := os.Link(object, path.Join(rootfs, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	label := "system_u:object_r:container_file_t:s0:c1,c2"
+	if err := relabel(rootfs, label); err != nil {
+		t.Skipf("Can't set SELinux labels here: %v", err)
+	}
+
+	after, _ := system.Lgetxattr(object, selinuxXattr)
+	if !bytes.Equal(before, after) {
+		t.Errorf("Hardlink outside the rootfs was relabeled from %q to %q", before, after)
+	}
+	copied, err := system.Lgetxattr(path.Join(rootfs, "file"), selinuxXattr)
+	// SELinux reports labels NUL-terminated
+	if err != nil || string(bytes.TrimRight(copied, "\x00")) != label {
+		t.Errorf("File in the rootfs was not labeled: %q, %v", copied, err)
+	}
+	if body, err := ioutil.ReadFile(path.Join(rootfs, "file")); err != nil || string(body) != "shared" {
+		t.Errorf("Unexpected contents after relabeling: %q, %v", body, err)
+	}
+}
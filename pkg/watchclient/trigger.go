@@ -0,0 +1,73 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"strings"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+// What moved a tag to its current image
+const (
+	// An image was pushed to the tag
+	triggerPush = "push"
+	// The tag was imported from another registry, e.g. by oc import-image
+	triggerImport = "import"
+	// A scheduled import found the tag changed upstream
+	triggerScheduledImport = "scheduled-import"
+	// The tag was pointed at another ImageStreamTag or ImageStreamImage,
+	// e.g. by oc tag
+	triggerTag = "tag"
+	// The tag was exploded on request, by os-explode explode
+	triggerExplode = "explode"
+	// The tag was imported from an image archive, by os-explode import
+	triggerArchive = "archive"
+)
+
+// Work out what moved a tag of an ImageStream to its current image.
+// ImageStreamTags and ImageStreamImports are views onto and requests
+// against ImageStreams which can't be watched themselves, so this is read
+// off the tag's spec and status: a spec tag from a DockerImage is
+// imported (unless the image is in the stream's own repository), one from
+// another stream is tagged, and anything else was pushed. An import which
+// kept the spec tag generation of the one before was not asked for, so it
+// comes from the schedule.
+func tagTrigger(is *imageapi.ImageStream, tag string) string {
+	events := is.Status.Tags[tag].Items
+	spec, ok := is.Spec.Tags[tag]
+	if len(events) == 0 || !ok || spec.From == nil {
+		return triggerPush
+	}
+
+	switch spec.From.Kind {
+	case "ImageStreamTag", "ImageStreamImage":
+		return triggerTag
+	case "DockerImage":
+		// Images may still be pushed to tags imported from elsewhere
+		repo := is.Status.DockerImageRepository
+		if repo != "" && strings.HasPrefix(events[0].DockerImageReference, repo+"@") {
+			return triggerPush
+		}
+		if spec.ImportPolicy.Scheduled && len(events) > 1 && events[0].Generation == events[1].Generation {
+			return triggerScheduledImport
+		}
+		return triggerImport
+	}
+	return triggerPush
+}
@@ -0,0 +1,60 @@
+package watchclient
+
+import (
+	"testing"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestTagTrigger(t *testing.T) {
+	repo := "172.30.1.1:5000/myproject/app"
+	events := func(refs ...string) imageapi.TagEventList {
+		var list imageapi.TagEventList
+		for i, ref := range refs {
+			// The newest event comes first
+			list.Items = append(list.Items, imageapi.TagEvent{DockerImageReference: ref, Generation: int64(len(refs) - i + 1)})
+		}
+		// A third event was imported on schedule, under the same generation
+		if len(refs) > 2 {
+			list.Items[0].Generation = list.Items[1].Generation
+		}
+		return list
+	}
+	from := func(kind string, scheduled bool) *imageapi.TagReference {
+		return &imageapi.TagReference{
+			From:         &kapi.ObjectReference{Kind: kind, Name: "docker.io/library/fedora:latest"},
+			ImportPolicy: imageapi.TagImportPolicy{Scheduled: scheduled},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		spec     *imageapi.TagReference
+		status   imageapi.TagEventList
+		expected string
+	}{
+		{"pushed", nil, events(repo + "@sha256:aaaa"), triggerPush},
+		{"spec tag without source", &imageapi.TagReference{}, events("docker.io/library/fedora@sha256:aaaa"), triggerPush},
+		{"imported", from("DockerImage", false), events("docker.io/library/fedora@sha256:aaaa"), triggerImport},
+		{"pushed over import", from("DockerImage", false), events(repo + "@sha256:aaaa"), triggerPush},
+		{"scheduled, first import", from("DockerImage", true), events("docker.io/library/fedora@sha256:aaaa"), triggerImport},
+		{"scheduled, reimported", from("DockerImage", true), events("docker.io/library/fedora@sha256:bbbb", "docker.io/library/fedora@sha256:aaaa"), triggerImport},
+		{"scheduled, upstream moved", from("DockerImage", true), events("docker.io/library/fedora@sha256:cccc", "docker.io/library/fedora@sha256:bbbb", "docker.io/library/fedora@sha256:aaaa"), triggerScheduledImport},
+		{"tagged", from("ImageStreamTag", false), events("172.30.1.1:5000/myproject/base@sha256:aaaa"), triggerTag},
+		{"tagged by digest", from("ImageStreamImage", false), events(repo + "@sha256:aaaa"), triggerTag},
+	}
+	for _, c := range cases {
+		is := &imageapi.ImageStream{
+			Spec:   imageapi.ImageStreamSpec{Tags: map[string]imageapi.TagReference{}},
+			Status: imageapi.ImageStreamStatus{DockerImageRepository: repo, Tags: map[string]imageapi.TagEventList{"latest": c.status}},
+		}
+		if c.spec != nil {
+			is.Spec.Tags["latest"] = *c.spec
+		}
+		if trigger := tagTrigger(is, "latest"); trigger != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, trigger)
+		}
+	}
+}
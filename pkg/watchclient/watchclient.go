@@ -18,17 +18,28 @@
 package watchclient
 
 import (
+	"crypto/tls"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	docker "github.com/fsouza/go-dockerclient"
+
 	"github.com/openshift/origin/pkg/client"
 
 	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
 	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
 
 	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
 )
@@ -38,11 +49,34 @@ const k8sServiceAccountTokenEnv = "KUBERNETES_SERVICE_TOKEN"
 const k8sServiceHostEnv = "KUBERNETES_SERVICE_HOST"
 const k8sServicePortEnv = "KUBERNETES_SERVICE_PORT"
 const osNamespaceEnv = "OS_WATCH_NAMESPACE"
+const osNamespaceExcludeEnv = "OS_WATCH_NAMESPACE_EXCLUDE"
 const repoPathEnv = "OSTREE_REPO_PATH"
 const blobSourceEnv = "OS_IMAGE_BLOB_SOURCE"
 const apiInsecureEnv = "OS_WATCH_INSECURE"
 const dockerRegistryServiceHostEnv = "DOCKER_REGISTRY_SERVICE_HOST"
 const dockerRegistryServicePortEnv = "DOCKER_REGISTRY_SERVICE_PORT"
+const selinuxContextEnv = "OS_EXPLODE_SELINUX_CONTEXT"
+const layerConcurrencyEnv = "OS_EXPLODE_LAYER_CONCURRENCY"
+const layerSpoolEnv = "OS_EXPLODE_LAYER_SPOOL"
+const unpackFallbackEnv = "OS_EXPLODE_UNPACK_FALLBACK"
+const historyDepthEnv = "OS_EXPLODE_HISTORY_DEPTH"
+const labelSelectorEnv = "OS_EXPLODE_LABEL_SELECTOR"
+const optInEnv = "OS_EXPLODE_OPT_IN"
+const leaderElectEnv = "OS_EXPLODE_LEADER_ELECT"
+const leaderLockEnv = "OS_EXPLODE_LEADER_LOCK"
+const notifyListenEnv = "OS_EXPLODE_NOTIFY_LISTEN"
+const notifyTokenEnv = "OS_EXPLODE_NOTIFY_TOKEN"
+const notifyInsecureEnv = "OS_EXPLODE_NOTIFY_INSECURE"
+const watchSourcesEnv = "OS_EXPLODE_WATCH"
+const nodeNameEnv = "OS_EXPLODE_NODE_NAME"
+const podRegistrySourceEnv = "OS_EXPLODE_POD_REGISTRY_SOURCE"
+const podRegistryAuthEnv = "OS_EXPLODE_POD_REGISTRY_AUTH"
+const dockerEndpointEnv = "OS_EXPLODE_DOCKER_ENDPOINT"
+const gcIntervalEnv = "OS_EXPLODE_GC_INTERVAL"
+const gcKeepYoungerThanEnv = "OS_EXPLODE_GC_KEEP_YOUNGER_THAN"
+const retainDigestsEnv = "OS_EXPLODE_RETAIN_DIGESTS"
+const retainTagsEnv = "OS_EXPLODE_RETAIN_TAGS"
+const retainUnreferencedEnv = "OS_EXPLODE_RETAIN_UNREFERENCED"
 
 // RepoSubDir describes the subpath of an OSTree repo in a compliant image store
 const RepoSubDir = ".repo"
@@ -54,12 +88,75 @@ const defaultRepoPath = "/explode/"
 
 // Holds the state of the watcher
 type watchClient struct {
-	Client       *client.Client
-	Logger       *log.Entry
-	Namespace    string
-	OSTreeConfig ostreeconfig.OstreeConfig
-	BlobSource   *url.URL
-	Registry     string
+	Client              *client.Client
+	KubeClient          *kclient.Client
+	Logger              *log.Entry
+	Namespaces          []string
+	ExcludeNamespaces   []string
+	OSTreeConfig        ostreeconfig.OstreeConfig
+	BlobSource          *url.URL
+	Registry            string
+	SELinuxContext      string
+	LayerConcurrency    int
+	SpoolLayers         bool
+	UnpackFallback      bool
+	HistoryDepth        int
+	LabelSelector       labels.Selector
+	OptIn               bool
+	LeaderLockName      string
+	LeaderLockNamespace string
+	Identity            string
+	NotifyListen        string
+	NotifyToken         string
+	NotifyInsecure      bool
+	ImageStreamSource   bool
+	PodSource           bool
+	NodeName            string
+	PodRegistrySource   *url.URL
+	PodRegistryAuth     *url.Userinfo
+	DockerClient        *docker.Client
+	GCInterval          time.Duration
+	GCKeepYoungerThan   time.Duration
+	Retention           retentionPolicy
+	Token               string
+	BlobClient          *http.Client
+
+	// The ostree-go bindings keep their options in package-level
+	// variables, so calls into them must not overlap
+	ostreeLock sync.Mutex
+
+	// Held by explodes for reading, and by the garbage collector for
+	// writing
+	gcLock sync.RWMutex
+
+	// Local cache of cluster-scoped Images, keyed by digest
+	imageStore cache.Store
+
+	digestLocks   map[string]*digestLock
+	digestLocksMu sync.Mutex
+
+	// Events of the tags whose history is being synced, see
+	// queueHistorySync
+	historySyncs   map[string]*imageapi.TagEventList
+	historySyncsMu sync.Mutex
+
+	namespaceCache   map[string]namespaceAnnotations
+	namespaceCacheMu sync.Mutex
+
+	// Stop channels of the per-namespace informers
+	namespaceWatches   map[string]chan struct{}
+	namespaceWatchesMu sync.Mutex
+
+	// Image archives being exploded
+	archives   []*imageArchive
+	archivesMu sync.Mutex
+
+	// Serializes checkpoint writes
+	checkpointMu sync.Mutex
+
+	// The last leader record seen on the lock, and when it was seen
+	leaderObserved     string
+	leaderObservedTime time.Time
 }
 
 // Create a new watcher
@@ -72,9 +169,14 @@ func NewWatchClient() (*watchClient, error) {
 
 	baseurl := "https://" + host + ":" + port
 
-	var namespace string
-	if namespace = os.Getenv(osNamespaceEnv); namespace == "" {
-		namespace = kapi.NamespaceAll
+	// Globs of the namespaces to watch (all of them if empty), and of the
+	// namespaces to leave out
+	namespaces := splitList(os.Getenv(osNamespaceEnv))
+	excludenamespaces := splitList(os.Getenv(osNamespaceExcludeEnv))
+	for _, pattern := range append(namespaces, excludenamespaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.WithField("err", err).Fatalf("Couldn't parse namespace pattern %s", pattern)
+		}
 	}
 
 	basedir := os.Getenv(repoPathEnv)
@@ -95,48 +197,290 @@ func NewWatchClient() (*watchClient, error) {
 	} else {
 		blobsource, _ = url.Parse(DefaultBlobStore)
 	}
+	switch blobsource.Scheme {
+	case "file", "http", "https":
+	default:
+		log.WithField("scheme", blobsource.Scheme).Fatal("BlobSource scheme not implemented.")
+	}
 
 	dockerregistry := os.Getenv(dockerRegistryServiceHostEnv) + ":" + os.Getenv(dockerRegistryServicePortEnv)
 
+	// SELinux context to label checkouts with, if any
+	selinuxcontext := os.Getenv(selinuxContextEnv)
+
+	// Number of images per tag to keep exploded, the newest included
+	historydepth := defaultHistoryDepth
+	if hdraw := os.Getenv(historyDepthEnv); hdraw != "" {
+		historydepth, err = strconv.Atoi(hdraw)
+		if err != nil || historydepth < 1 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", historyDepthEnv, hdraw)
+		}
+	}
+
+	// Whether layers OSTree can't import from a stream may be unpacked to disk
+	unpackfallback := os.Getenv(unpackFallbackEnv) == "true"
+
+	// Number of layers of one image to decompress and commit at once
+	layerconcurrency := defaultLayerConcurrency
+	if lcraw := os.Getenv(layerConcurrencyEnv); lcraw != "" {
+		layerconcurrency, err = strconv.Atoi(lcraw)
+		if err != nil || layerconcurrency < 1 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", layerConcurrencyEnv, lcraw)
+		}
+	}
+
+	// Whether layers are decompressed onto disk before they are imported,
+	// so that they decompress in parallel, instead of streamed
+	spoollayers := os.Getenv(layerSpoolEnv) == "true"
+
+	// Only ImageStreams matching this selector are watched
+	labelselector := labels.Everything()
+	if lsraw := os.Getenv(labelSelectorEnv); lsraw != "" {
+		labelselector, err = labels.Parse(lsraw)
+		if err != nil {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", labelSelectorEnv, lsraw)
+		}
+	}
+
+	// Whether streams must be annotated (or live in an annotated project)
+	// to be exploded
+	optin := os.Getenv(optInEnv) == "true"
+
+	// ConfigMap ([<namespace>/]<name>) to elect a leader among replicas
+	// with, if enabled
+	var leaderlocknamespace, leaderlockname string
+	if os.Getenv(leaderElectEnv) == "true" {
+		leaderlockname = defaultLeaderLockName
+		if llraw := os.Getenv(leaderLockEnv); llraw != "" {
+			leaderlocknamespace, leaderlockname, err = cache.SplitMetaNamespaceKey(llraw)
+			if err != nil {
+				log.WithField("err", err).Fatalf("Couldn't parse %s=%s", leaderLockEnv, llraw)
+			}
+		}
+		if leaderlocknamespace == "" {
+			leaderlocknamespace = getNamespaceFromPod()
+		}
+	}
+
+	// Address to listen on for registry notifications, instead of
+	// watching the Kubernetes API, and the token notifications must carry,
+	// unless authentication is explicitly disabled
+	notifylisten := os.Getenv(notifyListenEnv)
+	notifytoken := os.Getenv(notifyTokenEnv)
+	notifyinsecure := os.Getenv(notifyInsecureEnv) == "true"
+	if notifylisten != "" && notifytoken == "" && !notifyinsecure {
+		log.Fatalf("%s requires %s, unless %s is \"true\"", notifyListenEnv, notifyTokenEnv, notifyInsecureEnv)
+	}
+
+	// Local Docker daemon to explode images of, instead of watching the
+	// Kubernetes API
+	var dockerclient *docker.Client
+	if deraw := os.Getenv(dockerEndpointEnv); deraw != "" {
+		if notifylisten != "" {
+			log.Fatalf("%s can't be used with %s", dockerEndpointEnv, notifyListenEnv)
+		}
+		dockerclient, err = docker.NewClient(deraw)
+		if err != nil {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", dockerEndpointEnv, deraw)
+		}
+	}
+
+	// Without the Kubernetes API, there is no lock to elect a leader with.
+	// One-shot explodes may also run without it, reading from the blob
+	// source alone.
+	standalone := notifylisten != "" || dockerclient != nil || host == ""
+	if standalone && leaderlockname != "" {
+		log.Fatalf("%s requires the Kubernetes API (%s), and can't be used with %s or %s", leaderElectEnv, k8sServiceHostEnv, notifyListenEnv, dockerEndpointEnv)
+	}
+
+	// What to explode: the tags of ImageStreams, the images Pods run, or
+	// both
+	imagestreamsource, podsource := true, false
+	if wsraw := os.Getenv(watchSourcesEnv); wsraw != "" {
+		imagestreamsource = false
+		for _, source := range splitList(wsraw) {
+			switch source {
+			case "imagestreams":
+				imagestreamsource = true
+			case "pods":
+				podsource = true
+			default:
+				log.Fatalf("Couldn't parse %s=%s", watchSourcesEnv, wsraw)
+			}
+		}
+	}
+
+	// Only Pods scheduled on this node are watched, if set
+	nodename := os.Getenv(nodeNameEnv)
+
+	// Registry to read the images Pods run from other registries from
+	var podregistrysource *url.URL
+	if prraw := os.Getenv(podRegistrySourceEnv); prraw != "" {
+		podregistrysource, err = url.Parse(prraw)
+		if err != nil || (podregistrysource.Scheme != "http" && podregistrysource.Scheme != "https") {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", podRegistrySourceEnv, prraw)
+		}
+	}
+
+	// Credentials for the pod registry source, which is never sent our
+	// token
+	var podregistryauth *url.Userinfo
+	if praraw := os.Getenv(podRegistryAuthEnv); praraw != "" {
+		comp := strings.SplitN(praraw, ":", 2)
+		if len(comp) != 2 || comp[0] == "" {
+			log.Fatalf("Couldn't parse %s: expected <username>:<password>", podRegistryAuthEnv)
+		}
+		podregistryauth = url.UserPassword(comp[0], comp[1])
+	}
+
+	// How often to collect garbage in the OSTree repo, if at all, and how
+	// old unneeded refs must be to be deleted
+	var gcinterval time.Duration
+	if giraw := os.Getenv(gcIntervalEnv); giraw != "" {
+		gcinterval, err = time.ParseDuration(giraw)
+		if err != nil || gcinterval < 0 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", gcIntervalEnv, giraw)
+		}
+	}
+	gckeepyoungerthan := defaultGCKeepYoungerThan
+	if gkraw := os.Getenv(gcKeepYoungerThanEnv); gkraw != "" {
+		gckeepyoungerthan, err = time.ParseDuration(gkraw)
+		if err != nil || gckeepyoungerthan < 0 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", gcKeepYoungerThanEnv, gkraw)
+		}
+	}
+
+	// What to keep exploded, unless overridden by a Project's annotations
+	retention := retentionPolicy{KeepTags: splitList(os.Getenv(retainTagsEnv))}
+	for _, pattern := range retention.KeepTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.WithField("err", err).Fatalf("Couldn't parse tag pattern %s", pattern)
+		}
+	}
+	if rdraw := os.Getenv(retainDigestsEnv); rdraw != "" {
+		retention.KeepDigests, err = strconv.Atoi(rdraw)
+		if err != nil || retention.KeepDigests < 0 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", retainDigestsEnv, rdraw)
+		}
+		// Digest limits only trim history entries, of which a depth of 1
+		// keeps none
+		if retention.KeepDigests > 0 && historydepth <= 1 {
+			log.Fatalf("%s requires %s to be greater than 1", retainDigestsEnv, historyDepthEnv)
+		}
+	}
+	if ruraw := os.Getenv(retainUnreferencedEnv); ruraw != "" {
+		retention.UnreferencedFor, err = time.ParseDuration(ruraw)
+		if err != nil || retention.UnreferencedFor < 0 {
+			log.WithField("err", err).Fatalf("Couldn't parse %s=%s", retainUnreferencedEnv, ruraw)
+		}
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		log.WithField("err", err).Fatal("Couldn't get hostname")
+	}
+
 	ctxLogger := log.WithFields(log.Fields{
 		"repo":       path.Join(basedir, RepoSubDir),
 		"blobsource": blobsource.String(),
 		"insecure":   insecure,
-		"namespace":  namespace,
+		"namespaces": namespaces,
+		"exclude":    excludenamespaces,
 		"url":        baseurl,
 		"registry":   dockerregistry,
+		"selinux":    selinuxcontext,
+		"layers":     layerconcurrency,
+		"unpack":     unpackfallback,
+		"history":    historydepth,
+		"selector":   labelselector.String(),
+		"optin":      optin,
+		"leaderlock": leaderlocknamespace + "/" + leaderlockname,
+		"identity":   identity,
+		"notify":     notifylisten,
+		"docker":     os.Getenv(dockerEndpointEnv),
+		"streams":    imagestreamsource,
+		"pods":       podsource,
+		"node":       nodename,
+		"gc":         gcinterval,
+		"gckeep":     gckeepyoungerthan,
+		"retention":  retention,
 	})
 	ctxLogger.Debug("Client info gathered.")
 
+	// In listener and Docker modes, and without an API host, the Kubernetes
+	// API isn't used at all; a token is only used to fetch from the
+	// registry, if one is given
 	var token string
-	if token = os.Getenv(k8sServiceAccountTokenEnv); token == "" {
-		token, err = getTokenFromPod()
-		if err != nil {
-			ctxLogger.Fatal("No available token.")
+	var c *client.Client
+	var kc *kclient.Client
+	if standalone {
+		token = os.Getenv(k8sServiceAccountTokenEnv)
+	} else {
+		if token = os.Getenv(k8sServiceAccountTokenEnv); token == "" {
+			token, err = getTokenFromPod()
+			if err != nil {
+				ctxLogger.Fatal("No available token.")
+			}
 		}
-	}
 
-	log.WithField("tok", token).Debug("Have my token.")
+		log.WithField("tok", token).Debug("Have my token.")
 
-	c, err := client.New(&restclient.Config{
-		Host:        baseurl,
-		BearerToken: token,
-		Insecure:    insecure,
-	})
-	if err != nil {
-		return nil, err
+		config := &restclient.Config{
+			Host:        baseurl,
+			BearerToken: token,
+			Insecure:    insecure,
+		}
+		c, err = client.New(config)
+		if err != nil {
+			return nil, err
+		}
+		kc, err = kclient.New(config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	wc := &watchClient{
-		Client:    c,
-		Logger:    ctxLogger,
-		Namespace: namespace,
+		Client:            c,
+		KubeClient:        kc,
+		Logger:            ctxLogger,
+		Namespaces:        namespaces,
+		ExcludeNamespaces: excludenamespaces,
 		OSTreeConfig: ostreeconfig.OstreeConfig{
 			FullPath: path.Join(basedir, RepoSubDir),
 			BasePath: basedir,
 		},
-		BlobSource: blobsource,
-		Registry:   dockerregistry,
+		BlobSource:          blobsource,
+		Registry:            dockerregistry,
+		SELinuxContext:      selinuxcontext,
+		LayerConcurrency:    layerconcurrency,
+		SpoolLayers:         spoollayers,
+		UnpackFallback:      unpackfallback,
+		HistoryDepth:        historydepth,
+		LabelSelector:       labelselector,
+		OptIn:               optin,
+		LeaderLockName:      leaderlockname,
+		LeaderLockNamespace: leaderlocknamespace,
+		Identity:            identity,
+		NotifyListen:        notifylisten,
+		NotifyToken:         notifytoken,
+		NotifyInsecure:      notifyinsecure,
+		ImageStreamSource:   imagestreamsource,
+		PodSource:           podsource,
+		NodeName:            nodename,
+		PodRegistrySource:   podregistrysource,
+		PodRegistryAuth:     podregistryauth,
+		DockerClient:        dockerclient,
+		GCInterval:          gcinterval,
+		GCKeepYoungerThan:   gckeepyoungerthan,
+		Retention:           retention,
+		Token:               token,
+		BlobClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
 	}
 	return wc, nil
 }
@@ -149,3 +493,12 @@ func getTokenFromPod() (string, error) {
 	}
 	return string(tok), nil
 }
+
+// Gets the namespace we run in from the k8s pod filesystem
+func getNamespaceFromPod() string {
+	ns, err := ioutil.ReadFile(path.Join(k8sServiceAccountSecretPath, "namespace"))
+	if err != nil {
+		return kapi.NamespaceDefault
+	}
+	return strings.TrimSpace(string(ns))
+}
@@ -0,0 +1,190 @@
+/*  os-explode: automatically decompress docker images in OpenShift
+ *  Copyright (C) 2016  Red Hat, Inc.
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchclient
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/system"
+)
+
+// Extended attributes of a layer, keyed by absolute path within the layer
+type layerXattrs map[string]map[string]string
+
+// Set the collected extended attributes on an unpacked layer. The docker
+// unpacker ignores xattr errors; we don't, since a dropped capability would
+// be invisible to scanners.
+func (xattrs layerXattrs) apply(root string) error {
+	for name, attrs := range xattrs {
+		target := path.Join(root, name)
+		for key, value := range attrs {
+			if err := system.Lsetxattr(target, key, []byte(value), 0); err != nil {
+				return fmt.Errorf("could not set %s on %s: %s", key, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Collect the extended attributes (PAX SCHILY.xattr.* records) carried by
+// an uncompressed layer stream, e.g. security.capability on ping, and
+// recreate the entries carrying them under dir, xattrs included. The
+// directory is overlaid onto the layer's tar import, whose libarchive may
+// not keep xattrs, so that the layer is imported in a single pass either
+// way. As the overlay also replaces the metadata of the directories on the
+// way, they get the mode, owner and xattrs the layer gives them.
+func extractXattrEntries(stream io.Reader, dir string) (layerXattrs, error) {
+	xattrs := layerXattrs{}
+	dirs := make(map[string]*tar.Header)
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[name] = hdr
+		}
+
+		switch {
+		case hdr.Typeflag == tar.TypeLink:
+			// Hardlinks share the xattrs of their target
+			if _, ok := xattrs[path.Clean("/"+hdr.Linkname)]; ok {
+				if err := extractParents(dir, name); err != nil {
+					return nil, err
+				}
+				if err := os.Link(path.Join(dir, path.Clean("/"+hdr.Linkname)), path.Join(dir, name)); err != nil {
+					return nil, err
+				}
+			}
+		case len(hdr.Xattrs) > 0:
+			xattrs[name] = hdr.Xattrs
+			if err := extractEntry(dir, name, hdr, tr); err != nil {
+				return nil, err
+			}
+		case hdr.Typeflag != tar.TypeDir && xattrs[name] != nil:
+			// A later entry without xattrs replaced this one
+			delete(xattrs, name)
+			os.RemoveAll(path.Join(dir, name))
+		}
+	}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		hdr, ok := dirs["/"+strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")]
+		if !ok {
+			// Parents missing from the layer are created as root's 0755
+			hdr = &tar.Header{Mode: 0755}
+		}
+		return setEntryMetadata(p, hdr)
+	})
+	return xattrs, err
+}
+
+// Create the parent directories of an entry under dir, refusing to follow
+// symlinks the layer put there
+func extractParents(dir, name string) error {
+	p := dir
+	for _, elem := range strings.Split(strings.Trim(path.Dir(name), "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		p = path.Join(p, elem)
+		info, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(p, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("%s is not a directory within the layer", p)
+		}
+	}
+	return nil
+}
+
+// Recreate a layer entry carrying xattrs under dir
+func extractEntry(dir, name string, hdr *tar.Header, tr io.Reader) error {
+	if err := extractParents(dir, name); err != nil {
+		return err
+	}
+	target := path.Join(dir, name)
+	if hdr.Typeflag != tar.TypeDir {
+		os.RemoveAll(target)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeDir:
+		// Its metadata is set once the layer is read
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("could not preserve the xattrs of %s: unsupported entry type %q", name, hdr.Typeflag)
+	}
+	return setEntryMetadata(target, hdr)
+}
+
+// Give an extracted entry the owner, mode and xattrs of its header. The
+// owner goes first, as changing it clears setuid bits and capabilities.
+func setEntryMetadata(target string, hdr *tar.Header) error {
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	for key, value := range hdr.Xattrs {
+		if err := system.Lsetxattr(target, key, []byte(value), 0); err != nil {
+			return fmt.Errorf("could not set %s on %s: %s", key, hdr.Name, err)
+		}
+	}
+	return nil
+}
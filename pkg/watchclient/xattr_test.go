@@ -0,0 +1,230 @@
+package watchclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/docker/pkg/system"
+
+	"github.com/willmtemple/os-explode/pkg/ostreeconfig"
+)
+
+// VFS_CAP_REVISION_2 with the effective bit set, permitting cap_net_raw
+var netRawCapability = string([]byte{
+	0x01, 0x00, 0x00, 0x02,
+	0x00, 0x20, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+})
+
+type testEntry struct {
+	hdr  *tar.Header
+	body string
+}
+
+// Build an uncompressed layer from a list of entries
+func buildLayer(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.body))
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A layer with a capability-bearing ping (and a hardlink to it), a user
+// xattr and a file without xattrs
+func xattrLayer(t *testing.T) []byte {
+	return buildLayer(t, []testEntry{
+		{&tar.Header{Name: "usr/", Mode: 0755, Typeflag: tar.TypeDir}, ""},
+		{&tar.Header{Name: "usr/bin/", Mode: 0755, Typeflag: tar.TypeDir}, ""},
+		{&tar.Header{
+			Name:     "usr/bin/ping",
+			Mode:     0755,
+			Typeflag: tar.TypeReg,
+			Xattrs:   map[string]string{"security.capability": netRawCapability},
+		}, "ping"},
+		{&tar.Header{
+			Name:     "usr/bin/tool",
+			Mode:     0755,
+			Typeflag: tar.TypeReg,
+			Xattrs:   map[string]string{"user.origin": "vendor"},
+		}, "tool"},
+		{&tar.Header{Name: "usr/bin/ping6", Linkname: "usr/bin/ping", Typeflag: tar.TypeLink}, ""},
+		{&tar.Header{Name: "etc/", Mode: 0750, Typeflag: tar.TypeDir}, ""},
+		{&tar.Header{Name: "etc/motd", Mode: 0644, Typeflag: tar.TypeReg}, "hello"},
+	})
+}
+
+// Gzip a layer into a registry-style blob store under dir, returning its digest
+func writeBlob(t *testing.T, dir string, layer []byte) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	hexsum := hex.EncodeToString(sum[:])
+	blobdir := path.Join(dir, "docker/registry/v2/blobs/sha256", hexsum[:2], hexsum)
+	if err := os.MkdirAll(blobdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(blobdir, "data"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "sha256:" + hexsum
+}
+
+func TestExtractXattrEntries(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Setting security.capability requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "xattr-entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	xattrs, err := extractXattrEntries(bytes.NewReader(xattrLayer(t)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(xattrs) != 2 {
+		t.Errorf("Expected xattrs for 2 files, got %d", len(xattrs))
+	}
+	if xattrs["/usr/bin/ping"]["security.capability"] != netRawCapability {
+		t.Error("Missing security.capability on /usr/bin/ping")
+	}
+	if xattrs["/usr/bin/tool"]["user.origin"] != "vendor" {
+		t.Error("Missing user.origin on /usr/bin/tool")
+	}
+
+	// Only the entries carrying xattrs and their parents are recreated
+	if _, err := os.Lstat(path.Join(dir, "etc")); err == nil {
+		t.Error("Entries without xattrs were extracted")
+	}
+	if _, err := os.Lstat(path.Join(dir, "usr/bin/ping6")); err != nil {
+		t.Error("Hardlink to an entry with xattrs was not recreated")
+	}
+	if body, err := ioutil.ReadFile(path.Join(dir, "usr/bin/ping")); err != nil || string(body) != "ping" {
+		t.Errorf("Unexpected /usr/bin/ping: %q, %v", body, err)
+	}
+	capability, err := system.Lgetxattr(path.Join(dir, "usr/bin/ping"), "security.capability")
+	if err != nil || string(capability) != netRawCapability {
+		t.Errorf("security.capability was not set: %v", err)
+	}
+	for _, p := range []string{"", "usr", "usr/bin"} {
+		if info, err := os.Stat(path.Join(dir, p)); err != nil || info.Mode().Perm() != 0755 {
+			t.Errorf("Unexpected mode of /%s: %v, %v", p, info.Mode(), err)
+		}
+	}
+}
+
+func TestXattrsSurviveCheckout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Setting security.capability requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "xattr-explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wc := &watchClient{
+		OSTreeConfig: ostreeconfig.OstreeConfig{
+			FullPath: path.Join(dir, RepoSubDir),
+			BasePath: dir,
+		},
+		BlobSource: &url.URL{Scheme: "file", Path: dir},
+	}
+	if err := wc.OSTreeConfig.InitRepo(); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := writeBlob(t, dir, xattrLayer(t))
+	commit, err := wc.commitLayer("test/xattrs", blob, "oci/test/xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := path.Join(dir, "rootfs")
+	if err := wc.checkoutLayer(commit, rootfs); err != nil {
+		t.Fatal(err)
+	}
+
+	capability, err := system.Lgetxattr(path.Join(rootfs, "usr/bin/ping"), "security.capability")
+	if err != nil {
+		t.Error(err)
+	} else if string(capability) != netRawCapability {
+		t.Error("security.capability was not preserved")
+	}
+
+	origin, err := system.Lgetxattr(path.Join(rootfs, "usr/bin/tool"), "user.origin")
+	if err != nil {
+		t.Error(err)
+	} else if string(origin) != "vendor" {
+		t.Error("user.origin was not preserved")
+	}
+}
+
+func TestExtractXattrEntriesStaysInside(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Setting security.capability requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "xattr-entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := path.Join(dir, "outside")
+	inside := path.Join(dir, "inside")
+	os.Mkdir(outside, 0755)
+	os.Mkdir(inside, 0755)
+
+	layer := buildLayer(t, []testEntry{
+		{&tar.Header{
+			Name:     "usr",
+			Linkname: outside,
+			Typeflag: tar.TypeSymlink,
+			Xattrs:   map[string]string{"trusted.origin": "vendor"},
+		}, ""},
+		{&tar.Header{
+			Name:     "usr/ping",
+			Mode:     0755,
+			Typeflag: tar.TypeReg,
+			Xattrs:   map[string]string{"security.capability": netRawCapability},
+		}, "ping"},
+	})
+	if _, err := extractXattrEntries(bytes.NewReader(layer), inside); err == nil {
+		t.Error("Expected a symlinked parent to be refused")
+	}
+	if _, err := os.Lstat(path.Join(outside, "ping")); err == nil {
+		t.Error("An entry was written through a symlink")
+	}
+}